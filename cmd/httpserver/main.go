@@ -1,32 +1,49 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"httpfromtcp/internal/server"
+	"httpfromtcp/internal/websocket"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strings"
 	"syscall"
+	"time"
 )
 
 const port = 42069
 
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	server, err := server.Serve(port, test_handler)
+	router := server.NewRouter()
+	router.Handle("/yourproblem", handler400)
+	router.Handle("/myproblem", handler500)
+	router.Handle("GET /video", handlerVideo)
+	router.Handle("GET /clock", handlerClock)
+	router.Handle("GET /echo", handlerEcho)
+	router.Handle("GET /httpbin/{path...}", handlerHTTPBIN)
+	router.Handle("/{path...}", handler200)
+
+	handler := server.Chain(router.ServeHTTP, server.Logger(nil), server.Recoverer, server.RequestID)
+	server, err := server.ServeWithConfig(port, handler, server.Config{
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		H2C:               true,
+	})
 	if err != nil {
 		log.Fatalf("error starting server: %v", err)
 	}
 
-	defer server.Close()
-
 	log.Println("Server started on port: ", port)
 
 	// make a signal that waits until a syscal signal is sent to the channel.
@@ -34,6 +51,13 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	// give requests in progress a chance to finish
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("error shutting down: %v", err)
+	}
 	log.Println("Server gracefully stopped.")
 }
 
@@ -53,27 +77,6 @@ func main() {
 // 	return nil
 // }
 
-func test_handler(w *response.Writer, req *request.Request) {
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		handler400(w, req)
-		return
-	}
-	if req.RequestLine.RequestTarget == "/myproblem" {
-		handler500(w, req)
-		return
-	}
-	if req.RequestLine.RequestTarget == "/video" {
-		handlerVideo(w, req)
-		return
-	}
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		handlerHTTPBIN(w, req)
-		return
-	}
-	handler200(w, req)
-	return
-}
-
 func handlerVideo(w *response.Writer, req *request.Request) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -92,15 +95,57 @@ func handlerVideo(w *response.Writer, req *request.Request) {
 	}
 	w.WriteStatusLine(response.StatusCodeSuccess)
 	h := response.GetDefaultHeaders(len(videoFile))
-	h.Override("Content-Type", "video/mp4")
+	h.Set("Content-Type", "video/mp4")
 	w.WriteHeaders(h)
 	w.WriteBody(videoFile)
 	return
 }
 
+// streams the time every second until the client goes away
+func handlerClock(w *response.Writer, req *request.Request) {
+	stream, err := response.NewEventStream(w, 15*time.Second)
+	if err != nil {
+		fmt.Println("Event stream ERROR: ", err)
+		return
+	}
+	defer stream.Close()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for id := 1; ; id++ {
+		select {
+		case now := <-ticker.C:
+			stream.Send(response.Event{Event: "tick", ID: fmt.Sprint(id), Data: now.Format(time.RFC3339)})
+		case <-stream.Done():
+			return
+		}
+	}
+}
+
+// sends every WebSocket message straight back
+func handlerEcho(w *response.Writer, req *request.Request) {
+	ws, err := websocket.Upgrade(w, req)
+	if err != nil {
+		fmt.Println("WebSocket upgrade ERROR: ", err)
+		return
+	}
+	defer ws.Close()
+	for {
+		msgType, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(msgType, msg); err != nil {
+			return
+		}
+	}
+}
+
 func handlerHTTPBIN(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	routed_target := "https://httpbin.org/" + target
+	routed_target := "https://httpbin.org/" + req.Param("path")
+	if req.Target.RawQuery != "" {
+		routed_target += "?" + req.Target.RawQuery
+	}
 
 	fmt.Println("Proxying to >> ", routed_target)
 	http_resp, resp_err := http.Get(routed_target)
@@ -112,10 +157,10 @@ func handlerHTTPBIN(w *response.Writer, req *request.Request) {
 
 	w.WriteStatusLine(response.StatusCodeSuccess)
 	h := response.GetDefaultHeaders(0)
-	h.Override("Transfer-Encoding", "chunked")
-	h.Remove("Content-Length") // chaning length and setting encoding
-	h.Set("Trailer", "X-Content-SHA256")
-	h.Set("Trailer", "X-Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Del("Content-Length") // chaning length and setting encoding
+	h.Add("Trailer", "X-Content-SHA256")
+	h.Add("Trailer", "X-Content-Length")
 
 	w.WriteHeaders(h)
 
@@ -129,12 +174,15 @@ func handlerHTTPBIN(w *response.Writer, req *request.Request) {
 		fmt.Println("\t", n, "- bytes, read from httpbin")
 		if n > 0 {
 			totalResponseBody = append(totalResponseBody, buf[:n]...)
-			_, err = w.WriteChunkedBody(buf)
-			if err != nil {
-				fmt.Println("WriteChunkedBody ERROR: ", err)
+			if _, werr := w.WriteChunkedBody(buf[:n]); werr != nil {
+				fmt.Println("WriteChunkedBody ERROR: ", werr)
+				break
+			}
+			// pass each piece on as it arrives rather than when the buffer fills
+			if werr := w.Flush(); werr != nil {
+				fmt.Println("Flush ERROR: ", werr)
 				break
 			}
-
 		}
 		if err == io.EOF {
 			break
@@ -151,8 +199,8 @@ func handlerHTTPBIN(w *response.Writer, req *request.Request) {
 	}
 	trailers := headers.NewHeaders()
 	shaSum := sha256.Sum256(totalResponseBody)
-	trailers.Override("X-Content-SHA256", fmt.Sprintf("%x", shaSum[:]))
-	trailers.Override("X-Content-Length", fmt.Sprintf("%d", len(totalResponseBody)))
+	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", shaSum[:]))
+	trailers.Set("X-Content-Length", fmt.Sprintf("%d", len(totalResponseBody)))
 	err = w.WriteTrailers(trailers)
 	if err != nil {
 		fmt.Println("\tError writing trailers: ", err)
@@ -174,7 +222,7 @@ func handler400(w *response.Writer, _ *request.Request) {
 </body>
 </html>`)
 	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 	return
@@ -192,7 +240,7 @@ func handler500(w *response.Writer, _ *request.Request) {
 </body>
 </html>`)
 	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 	return
@@ -210,7 +258,7 @@ func handler200(w *response.Writer, _ *request.Request) {
 </body>
 </html>`)
 	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
 	w.WriteBody(body)
 	return
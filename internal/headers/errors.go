@@ -0,0 +1,19 @@
+package headers
+
+import "errors"
+
+var (
+	// ErrMalformedFieldLine is a field line that isn't name: value.
+	ErrMalformedFieldLine = errors.New("malformed field line")
+	// ErrInvalidFieldName is a field name with characters outside of token.
+	ErrInvalidFieldName = errors.New("invalid field name")
+	// ErrInvalidFieldValue is a field value with CR, LF, NUL or another
+	// control character in it.
+	ErrInvalidFieldValue = errors.New("invalid field value")
+	// ErrObsFold is a field value continued on the next line, which
+	// ParseStrict doesn't allow.
+	ErrObsFold = errors.New("obsolete line folding")
+	// ErrBareLF is a line ended by LF without CR, which ParseStrict doesn't
+	// allow.
+	ErrBareLF = errors.New("bare LF line ending")
+)
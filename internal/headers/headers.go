@@ -2,9 +2,7 @@ package headers
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"regexp"
 	"strings"
 )
 
@@ -16,89 +14,237 @@ const (
 // field-line = field-name: OWS field-value OWS \r\n
 // ows = optional white space
 
-type Headers map[string]string
+// Headers keeps every field line in the order it was added, with the name
+// as it was sent. Lookups ignore case. The zero value is ready to use.
+// Add and Set take names and values as they are, they're checked with
+// ValidateField when parsed and when written out.
+type Headers struct {
+	fields []Field
+}
+
+// Field is a single field line.
+type Field struct {
+	Name  string
+	Value string
+}
+
+func NewHeaders() *Headers {
+	return &Headers{}
+}
+
+// Parse reads one field line off data, or the empty line ending the
+// section, in which case done is true. It returns 0 bytes consumed when the
+// line isn't complete yet.
+// It's lenient the way RFC 9112 allows: a bare LF ends a line and an
+// obs-fold continuation line is joined to the field before it.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false)
+}
 
-func NewHeaders() Headers {
-	return make(map[string]string)
+// ParseStrict is Parse, but a bare LF or an obs-fold is an error. Two
+// parsers that disagree on where a line ends are how requests get smuggled
+// past a proxy.
+func (h *Headers) ParseStrict(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true)
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	idx := bytes.Index(data, []byte(crlf))
-	if idx == -1 { // not enough header info
-		return 0, false, nil
-	} else if idx == 0 { // crlf is at start, means we finished reading headers
-		// 2 is to consume the crlf
-		return 2, true, nil
+func (h *Headers) parse(data []byte, strict bool) (n int, done bool, err error) {
+	line, n, err := ReadLine(data, strict)
+	if err != nil || n == 0 { // not enough header info
+		return 0, false, err
+	} else if len(line) == 0 { // crlf is at start, means we finished reading headers
+		return n, true, nil
 	}
-	header_string := string(data[:idx]) // bytes.SplitN is used instead
+
+	// obs-fold = OWS CRLF RWS, a line starting with white space continues
+	// the one before it
+	if line[0] == ' ' || line[0] == '\t' {
+		if len(h.fields) == 0 {
+			// nothing to continue, RFC 9112 2.2
+			return 0, false, fmt.Errorf("%w: white space before the first field %q", ErrMalformedFieldLine, line)
+		}
+		if strict {
+			return 0, false, fmt.Errorf("%w: %q", ErrObsFold, line)
+		}
+		last := &h.fields[len(h.fields)-1]
+		val := strings.Trim(string(line), " \t")
+		if err := ValidateField(last.Name, val); err != nil {
+			return 0, false, err
+		}
+		last.Value = strings.TrimRight(last.Value+" "+val, " ")
+		return n, false, nil
+	}
+
+	header_string := string(line)
 	key, val, found := strings.Cut(header_string, ":")
 	if !found {
-		return 0, false, errors.New("Could not find : in header.")
+		return 0, false, fmt.Errorf("%w: could not find : in %q", ErrMalformedFieldLine, header_string)
 	}
 	// can't be any space between key and :
 	// if there isn't any space between key and char, the length should be the same
 	if len(key) != len(strings.TrimRight(key, " ")) {
-		return 0, false, errors.New("White space found in key.")
+		return 0, false, fmt.Errorf("%w: white space found in key %q", ErrMalformedFieldLine, key)
 	}
 
-	// key = cleanKey(key) // moved to within set as set can be called by outside of this parse function
-	val = strings.TrimSpace(val)
+	val = strings.Trim(val, " \t") // OWS
 
-	if !validateKey(key) {
-		return 0, false, errors.New("Invalid key.")
+	if err := ValidateField(key, val); err != nil {
+		return 0, false, err
 	}
 
-	h.Set(key, val)
+	h.Add(key, val)
+
+	return n, false, nil
+}
+
+// ReadLine returns the line at the start of data, without its line ending,
+// and how many bytes it took up. n is 0 if there's no full line yet.
+// A bare LF ends a line unless strict is set, RFC 9112 2.2 leaves that up
+// to the recipient.
+func ReadLine(data []byte, strict bool) (line []byte, n int, err error) {
+	idx := bytes.IndexByte(data, '\n')
+	if idx == -1 {
+		return nil, 0, nil
+	}
+	if idx == 0 || data[idx-1] != '\r' {
+		if strict {
+			return nil, 0, ErrBareLF
+		}
+		return data[:idx], idx + 1, nil
+	}
+	return data[:idx-1], idx + 1, nil
+}
+
+// ValidateField checks a field line against RFC 9110 5.1 and 5.5: the name
+// has to be a token and the value can't hold control characters other than
+// tab. A CR or LF in a value would let it start a new field line, or end the
+// header section, on the wire.
+func ValidateField(key, value string) error {
+	if !validateKey(key) {
+		return fmt.Errorf("%w: %q", ErrInvalidFieldName, key)
+	}
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return fmt.Errorf("%w: byte %#x in value of %s", ErrInvalidFieldValue, c, key)
+		}
+	}
+	return nil
+}
 
-	return (idx + 2), false, nil
+// Add appends a field line, keeping any already there with the same name.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: strings.TrimSpace(key), Value: value})
 }
 
-// Adds to headers, but appends if header already exists
-func (h Headers) Set(key, value string) {
-	key = cleanKey(key)
-	if val, ok := h[key]; ok {
-		if strings.Contains(val, value) { // if value is already in my map
+// Set replaces every field line named key with a single one. It keeps the
+// position of the first one, or goes last if there wasn't any.
+func (h *Headers) Set(key, value string) {
+	key = strings.TrimSpace(key)
+	for i, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			h.fields[i].Value = value
+			h.del(key, i+1)
 			return
 		}
-		h[key] = fmt.Sprintf("%s, %s", val, value)
-	} else {
-		h[key] = value
 	}
+	h.Add(key, value)
 }
 
-// Overwrites instead of appending
-func (h Headers) Override(key, value string) {
-	key = strings.ToLower(key)
-	h[key] = value
+// Del removes every field line named key.
+func (h *Headers) Del(key string) {
+	h.del(strings.TrimSpace(key), 0)
 }
 
-// Deletes key/value from map based on key
-func (h Headers) Remove(key string) {
-	key = strings.ToLower(key)
-	delete(h, key)
+// removes the lines named key from index from on
+func (h *Headers) del(key string, from int) {
+	kept := h.fields[:from]
+	for _, f := range h.fields[from:] {
+		if !strings.EqualFold(f.Name, key) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	val, ok := h[strings.ToLower(key)]
-	return val, ok
+// Get returns the combined value of key: every value joined with ", ", the
+// way RFC 9110 5.3 lets a recipient merge repeated fields. That's wrong for
+// Set-Cookie, which has to be read with Values.
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ", "), true
 }
 
-func validateKey(key string) bool {
-	if len(key) < 1 {
-		return false
+// Values returns the value of every field line named key, in order.
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			values = append(values, f.Value)
+		}
 	}
-	validChars := "[\\w!#$%&'*+-.^`|~]"
-	pattern := regexp.MustCompile(validChars)
-	valid := true
+	return values
+}
 
-	for _, r := range key {
-		valid = valid && pattern.MatchString(string(r))
+// HasToken reports whether the comma separated list in the fields named key
+// holds token, ignoring case. It's for list fields like Connection or
+// Transfer-Encoding.
+func (h *Headers) HasToken(key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
 	}
-	return valid
+	return false
+}
+
+// Fields returns the field lines in order. The slice belongs to h.
+func (h *Headers) Fields() []Field {
+	return h.fields
 }
 
-func cleanKey(key string) string {
-	return strings.TrimSpace(strings.ToLower(key))
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// CanonicalKey returns key with the first letter and every letter after a
+// hyphen upper cased and the rest lower cased, "content-length" becomes
+// "Content-Length". Keys that aren't valid field names come back as is.
+func CanonicalKey(key string) string {
+	if !validateKey(key) {
+		return key
+	}
+	b := []byte(key)
+	upper := true
+	for i, c := range b {
+		switch {
+		case upper && c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case !upper && c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+		upper = c == '-'
+	}
+	return string(b)
+}
+
+func validateKey(key string) bool {
+	if len(key) < 1 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			bytes.IndexByte(tokenChars, c) >= 0) {
+			return false
+		}
+	}
+	return true
 }
 
 var tokenChars = []byte{'!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~'}
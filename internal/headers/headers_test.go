@@ -14,28 +14,30 @@ func TestRequestLineParse(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
-	// Test: Valid single header with extra whitespace
+	// Test: White space before the name isn't part of a field line
 	headers = NewHeaders()
 	data = []byte("       Host: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.NoError(t, err)
-	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, 30, n)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
+	assert.Equal(t, 0, n)
 	assert.False(t, done)
+	assert.Equal(t, 0, headers.Len())
+	_, _, err = headers.ParseStrict(data)
+	assert.ErrorIs(t, err, ErrMalformedFieldLine)
 
 	// Test: Valid 2 headers with existing headers
-	headers = map[string]string{"host": "localhost:42069"}
+	headers = NewHeaders()
+	headers.Add("Host", "localhost:42069")
 	data = []byte("User-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(headers, "user-agent"))
 	assert.Equal(t, 25, n)
 	assert.False(t, done)
 
@@ -53,18 +55,20 @@ func TestRequestLineParse(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	assert.True(t, done)
 
-	// Test: Headers saved as lower case
+	// Test: Headers keep their casing, lookups ignore it
 	headers = NewHeaders()
 	data = []byte("Host: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
-	assert.Equal(t, "localhost:42069", headers["host"])
-	assert.Equal(t, "", headers["Host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	assert.Equal(t, "localhost:42069", get(headers, "HOST"))
+	assert.Equal(t, []Field{{Name: "Host", Value: "localhost:42069"}}, headers.Fields())
 
 	// Test: Validate Key
 	headers = NewHeaders()
 	data = []byte("H@st: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrInvalidFieldName)
 
 	// Test: Multiple Keyst
 	headers = NewHeaders()
@@ -75,5 +79,143 @@ func TestRequestLineParse(t *testing.T) {
 		n, done_status, err = headers.Parse(data[readBytes:])
 		readBytes += n
 	}
-	require.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", headers["set-person"])
+	require.Equal(t, "lane-loves-go, prime-loves-zig, tj-loves-ocaml", get(headers, "set-person"))
+	assert.Equal(t, []string{"lane-loves-go", "prime-loves-zig", "tj-loves-ocaml"}, headers.Values("Set-Person"))
+
+	// Test: Duplicate values are kept
+	headers = NewHeaders()
+	data = []byte("Set-Cookie: a=1\r\nSet-Cookie: a=1; Path=/\r\nSet-Cookie: a=1\r\n\r\n")
+	readBytes, done_status = 0, false
+	for !done_status {
+		n, done_status, err = headers.Parse(data[readBytes:])
+		require.NoError(t, err)
+		readBytes += n
+	}
+	assert.Equal(t, []string{"a=1", "a=1; Path=/", "a=1"}, headers.Values("set-cookie"))
+}
+
+func TestHeadersEdit(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Accept", "text/html")
+	h.Add("Vary", "Origin")
+	h.Add("accept", "*/*")
+
+	// Test: Set replaces every line but keeps the first one's place
+	h.Set("ACCEPT", "application/json")
+	assert.Equal(t, []Field{{"Accept", "application/json"}, {"Vary", "Origin"}}, h.Fields())
+
+	// Test: Set on a new key appends
+	h.Set("X-Id", "1")
+	assert.Equal(t, 3, h.Len())
+	assert.Equal(t, "X-Id", h.Fields()[2].Name)
+
+	// Test: Del removes every line
+	h.Add("vary", "Accept")
+	h.Del("Vary")
+	assert.Nil(t, h.Values("vary"))
+	_, ok := h.Get("Vary")
+	assert.False(t, ok)
+	assert.Equal(t, 2, h.Len())
+
+	// Test: the zero value works
+	var zero Headers
+	zero.Add("A", "1")
+	assert.Equal(t, []string{"1"}, zero.Values("a"))
+}
+
+func TestHasToken(t *testing.T) {
+	h := NewHeaders()
+	h.Add("Connection", "keep-alive , Upgrade")
+	h.Add("connection", "HTTP2-Settings")
+
+	// Test: any element of any line, ignoring case and white space
+	assert.True(t, h.HasToken("Connection", "upgrade"))
+	assert.True(t, h.HasToken("CONNECTION", "http2-settings"))
+	assert.True(t, h.HasToken("Connection", "keep-alive"))
+
+	// Test: a token has to match a whole element
+	assert.False(t, h.HasToken("Connection", "keep"))
+	assert.False(t, h.HasToken("Upgrade", "upgrade"))
+}
+
+// get returns the combined value of key, "" when it's missing.
+func get(h *Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
+}
+
+func TestFieldValidation(t *testing.T) {
+	// Test: control bytes in a value
+	for _, line := range []string{"X-A: a\x00b\r\n", "X-A: a\rb\r\n", "X-A: \x7f\r\n", "X-A: \x01\r\n"} {
+		_, _, err := NewHeaders().Parse([]byte(line))
+		assert.ErrorIs(t, err, ErrInvalidFieldValue, "%q", line)
+	}
+
+	// Test: tabs, obs-text and surrounding OWS are fine
+	h := NewHeaders()
+	_, _, err := h.Parse([]byte("X-A: \t a\tb caf\xc3\xa9 \t\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "a\tb caf\xc3\xa9", get(h, "x-a"))
+
+	// Test: names have to be tokens
+	for _, key := range []string{"a,b", "a/b", "a@b", "", "a\x00"} {
+		assert.ErrorIs(t, ValidateField(key, "v"), ErrInvalidFieldName, "%q", key)
+	}
+	assert.NoError(t, ValidateField("X-Custom_Header.1~", "v"))
+}
+
+func TestLineEndings(t *testing.T) {
+	// Test: a bare LF ends the line, or is refused when strict
+	h := NewHeaders()
+	n, done, err := h.Parse([]byte("X-A: a\nX-B: b\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 7, n)
+	assert.False(t, done)
+	assert.Equal(t, "a", get(h, "x-a"))
+	n, done, err = h.Parse([]byte("\n"))
+	require.NoError(t, err)
+	assert.True(t, done)
+
+	_, _, err = NewHeaders().ParseStrict([]byte("X-A: a\nX-B: b\r\n"))
+	assert.ErrorIs(t, err, ErrBareLF)
+	_, _, err = NewHeaders().ParseStrict([]byte("\n"))
+	assert.ErrorIs(t, err, ErrBareLF)
+
+	// Test: obs-fold is joined to the field before it, or refused when strict
+	data := []byte("X-A: a\r\n  b\r\n\tc \r\nTransfer-Encoding: chunked\r\n")
+	h = NewHeaders()
+	var read int
+	for range 4 {
+		n, _, err = h.Parse(data[read:])
+		require.NoError(t, err)
+		read += n
+	}
+	assert.Equal(t, "a b c", get(h, "x-a"))
+	assert.Equal(t, 2, h.Len())
+
+	h = NewHeaders()
+	n, _, err = h.ParseStrict(data)
+	require.NoError(t, err)
+	_, _, err = h.ParseStrict(data[n:])
+	assert.ErrorIs(t, err, ErrObsFold)
+
+	// Test: a folded line can't sneak in control bytes either
+	h = NewHeaders()
+	n, _, _ = h.Parse(data)
+	_, _, err = h.Parse([]byte(" \x00\r\n"))
+	assert.ErrorIs(t, err, ErrInvalidFieldValue)
+}
+
+func TestCanonicalKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"content-length":   "Content-Length",
+		"CONTENT-TYPE":     "Content-Type",
+		"x-request-id":     "X-Request-Id",
+		"host":             "Host",
+		"www-authenticate": "Www-Authenticate",
+		"-odd--key-":       "-Odd--Key-",
+		"bad key":          "bad key",
+	} {
+		assert.Equal(t, want, CanonicalKey(key), key)
+	}
 }
@@ -0,0 +1,176 @@
+package http2
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+type FrameType uint8
+
+const (
+	FrameData         FrameType = 0x0
+	FrameHeaders      FrameType = 0x1
+	FramePriority     FrameType = 0x2
+	FrameRSTStream    FrameType = 0x3
+	FrameSettings     FrameType = 0x4
+	FramePushPromise  FrameType = 0x5
+	FramePing         FrameType = 0x6
+	FrameGoAway       FrameType = 0x7
+	FrameWindowUpdate FrameType = 0x8
+	FrameContinuation FrameType = 0x9
+)
+
+type Flags uint8
+
+const (
+	FlagEndStream  Flags = 0x1
+	FlagAck        Flags = 0x1 // SETTINGS and PING
+	FlagEndHeaders Flags = 0x4
+	FlagPadded     Flags = 0x8
+	FlagPriority   Flags = 0x20
+)
+
+const (
+	frameHeaderLen = 9
+	// Every endpoint takes frames this big, SETTINGS_MAX_FRAME_SIZE can
+	// only raise it.
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+	maxWindowSize       = 1<<31 - 1
+)
+
+// Frame is a frame as it comes off the wire, the payload isn't broken
+// down any further.
+type Frame struct {
+	Type     FrameType
+	Flags    Flags
+	StreamID uint32
+	Payload  []byte
+}
+
+func (f Frame) Has(flag Flags) bool {
+	return f.Flags&flag != 0
+}
+
+// ReadFrame reads the next frame off r. A payload over maxSize is a
+// FRAME_SIZE_ERROR *ConnectionError.
+func ReadFrame(r io.Reader, maxSize uint32) (Frame, error) {
+	var head [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return Frame{}, err
+	}
+	length := uint32(head[0])<<16 | uint32(head[1])<<8 | uint32(head[2])
+	f := Frame{
+		Type:     FrameType(head[3]),
+		Flags:    Flags(head[4]),
+		StreamID: binary.BigEndian.Uint32(head[5:]) & (1<<31 - 1), // the reserved bit is ignored
+	}
+	if length > maxSize {
+		return Frame{}, connError(ErrCodeFrameSize, "%d byte frame, the limit is %d", length, maxSize)
+	}
+	f.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes f to w in a single Write.
+func WriteFrame(w io.Writer, f Frame) error {
+	_, err := w.Write(appendFrame(nil, f))
+	return err
+}
+
+func appendFrame(buf []byte, f Frame) []byte {
+	length := len(f.Payload)
+	buf = append(buf, byte(length>>16), byte(length>>8), byte(length), byte(f.Type), byte(f.Flags))
+	buf = binary.BigEndian.AppendUint32(buf, f.StreamID)
+	return append(buf, f.Payload...)
+}
+
+// Strips the padding off a DATA or HEADERS payload.
+func unpad(f Frame) ([]byte, error) {
+	if !f.Has(FlagPadded) {
+		return f.Payload, nil
+	}
+	if len(f.Payload) == 0 {
+		return nil, connError(ErrCodeFrameSize, "padded frame without a pad length")
+	}
+	padLen := int(f.Payload[0])
+	if padLen >= len(f.Payload) {
+		return nil, connError(ErrCodeProtocol, "padding longer than the payload")
+	}
+	return f.Payload[1 : len(f.Payload)-padLen], nil
+}
+
+// headerBlock returns the header block fragment of a HEADERS frame, past
+// the padding and priority, which is deprecated and ignored.
+func headerBlock(f Frame) ([]byte, error) {
+	block, err := unpad(f)
+	if err != nil {
+		return nil, err
+	}
+	if f.Has(FlagPriority) {
+		if len(block) < 5 {
+			return nil, connError(ErrCodeFrameSize, "HEADERS too short for its priority")
+		}
+		block = block[5:]
+	}
+	return block, nil
+}
+
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize      SettingID = 0x1
+	SettingEnablePush           SettingID = 0x2
+	SettingMaxConcurrentStreams SettingID = 0x3
+	SettingInitialWindowSize    SettingID = 0x4
+	SettingMaxFrameSize         SettingID = 0x5
+	SettingMaxHeaderListSize    SettingID = 0x6
+)
+
+type Setting struct {
+	ID  SettingID
+	Val uint32
+}
+
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError(ErrCodeFrameSize, "SETTINGS payload of %d bytes", len(payload))
+	}
+	var settings []Setting
+	for ; len(payload) > 0; payload = payload[6:] {
+		settings = append(settings, Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(payload)),
+			Val: binary.BigEndian.Uint32(payload[2:]),
+		})
+	}
+	return settings, nil
+}
+
+func settingsFrame(settings ...Setting) Frame {
+	var payload []byte
+	for _, s := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(s.ID))
+		payload = binary.BigEndian.AppendUint32(payload, s.Val)
+	}
+	return Frame{Type: FrameSettings, Payload: payload}
+}
+
+func rstStreamFrame(id uint32, code ErrCode) Frame {
+	return Frame{Type: FrameRSTStream, StreamID: id, Payload: binary.BigEndian.AppendUint32(nil, uint32(code))}
+}
+
+func goAwayFrame(lastStreamID uint32, code ErrCode, debug string) Frame {
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	return Frame{Type: FrameGoAway, Payload: append(payload, debug...)}
+}
+
+func windowUpdateFrame(id uint32, increment uint32) Frame {
+	return Frame{Type: FrameWindowUpdate, StreamID: id, Payload: binary.BigEndian.AppendUint32(nil, increment)}
+}
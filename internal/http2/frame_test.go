@@ -0,0 +1,66 @@
+package http2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	// Test: a frame comes back as it went out
+	var buf bytes.Buffer
+	in := Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: 3, Payload: []byte("block")}
+	require.NoError(t, WriteFrame(&buf, in))
+	assert.Equal(t, []byte{0, 0, 5, 1, 5, 0, 0, 0, 3}, buf.Bytes()[:frameHeaderLen])
+	out, err := ReadFrame(&buf, defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, in, out)
+
+	// Test: the reserved bit is dropped
+	out, err = ReadFrame(bytes.NewReader([]byte{0, 0, 0, 4, 0, 0x80, 0, 0, 0}), defaultMaxFrameSize)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), out.StreamID)
+
+	// Test: a payload over the limit
+	buf.Reset()
+	require.NoError(t, WriteFrame(&buf, Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, 20)}))
+	_, err = ReadFrame(&buf, 10)
+	var ce *ConnectionError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, ErrCodeFrameSize, ce.Code)
+
+	// Test: cut off mid payload
+	_, err = ReadFrame(bytes.NewReader([]byte{0, 0, 5, 0, 0, 0, 0, 0, 1, 'a'}), defaultMaxFrameSize)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestFramePadding(t *testing.T) {
+	// Test: padding and priority are stripped off a HEADERS payload
+	f := Frame{Type: FrameHeaders, Flags: FlagPadded | FlagPriority, Payload: []byte{2, 0, 0, 0, 1, 16, 'h', 'i', 0, 0}}
+	block, err := headerBlock(f)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(block))
+
+	// Test: padding as long as the payload
+	_, err = unpad(Frame{Type: FrameData, Flags: FlagPadded, Payload: []byte{3, 0, 0}})
+	var ce *ConnectionError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, ErrCodeProtocol, ce.Code)
+}
+
+func TestSettings(t *testing.T) {
+	// Test: settings round trip through a SETTINGS payload
+	f := settingsFrame(Setting{SettingInitialWindowSize, 10}, Setting{SettingMaxFrameSize, 1 << 20})
+	settings, err := parseSettings(f.Payload)
+	require.NoError(t, err)
+	assert.Equal(t, []Setting{{SettingInitialWindowSize, 10}, {SettingMaxFrameSize, 1 << 20}}, settings)
+
+	// Test: a payload that isn't whole settings
+	_, err = parseSettings([]byte{0, 1, 0})
+	var ce *ConnectionError
+	require.ErrorAs(t, err, &ce)
+	assert.Equal(t, ErrCodeFrameSize, ce.Code)
+}
@@ -0,0 +1,392 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCompression is a header block the Decoder can't make sense of. Its
+// table may be out of step with the peer's after that, so it's a
+// COMPRESSION_ERROR for the whole connection.
+var ErrCompression = errors.New("hpack: invalid header block")
+
+// HeaderField is a header field as HPACK sees it, names are lowercase.
+// Sensitive fields are never put in a dynamic table.
+type HeaderField struct {
+	Name, Value string
+	Sensitive   bool
+}
+
+// RFC 7541 4.1: the 32 is a rough cost of an entry's overhead.
+func (f HeaderField) size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// The size both tables start at, SETTINGS_HEADER_TABLE_SIZE's default.
+const defaultTableSize = 4096
+
+// RFC 7541 Appendix A.
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable is the table both ends build up as fields are sent. Index 1
+// is the newest entry, the oldest ones are evicted to keep it in maxSize.
+type dynamicTable struct {
+	fields  []HeaderField // oldest first
+	size    uint32
+	maxSize uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.fields = append(t.fields, f)
+	t.size += f.size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(n uint32) {
+	t.maxSize = n
+	t.evict()
+}
+
+func (t *dynamicTable) evict() {
+	drop := 0
+	for t.size > t.maxSize && drop < len(t.fields) {
+		t.size -= t.fields[drop].size()
+		drop++
+	}
+	t.fields = t.fields[drop:]
+}
+
+// lookup returns the field at index i, static table first.
+func (t *dynamicTable) lookup(i uint64) (HeaderField, bool) {
+	if i == 0 {
+		return HeaderField{}, false
+	}
+	if i <= uint64(len(staticTable)) {
+		return staticTable[i-1], true
+	}
+	i -= uint64(len(staticTable))
+	if i > uint64(len(t.fields)) {
+		return HeaderField{}, false
+	}
+	return t.fields[len(t.fields)-int(i)], true
+}
+
+// search returns the index of an entry with f's name, 0 if there isn't
+// one, and whether it has f's value too.
+func (t *dynamicTable) search(f HeaderField) (uint64, bool) {
+	var nameIdx uint64
+	for i, sf := range staticTable {
+		if sf.Name != f.Name {
+			continue
+		}
+		if sf.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if nameIdx == 0 {
+			nameIdx = uint64(i + 1)
+		}
+	}
+	for i := len(t.fields) - 1; i >= 0; i-- {
+		if t.fields[i].Name != f.Name {
+			continue
+		}
+		idx := uint64(len(staticTable) + len(t.fields) - i)
+		if t.fields[i].Value == f.Value {
+			return idx, true
+		}
+		if nameIdx == 0 {
+			nameIdx = idx
+		}
+	}
+	return nameIdx, false
+}
+
+// Decoder decodes header blocks, its table follows the peer's Encoder so
+// blocks have to be decoded in the order they arrived.
+type Decoder struct {
+	table dynamicTable
+	// the most the peer may set its table to, our SETTINGS_HEADER_TABLE_SIZE
+	maxTableSize uint32
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		table:        dynamicTable{maxSize: defaultTableSize},
+		maxTableSize: defaultTableSize,
+	}
+}
+
+// Decode decodes a whole header block, errors wrap ErrCompression.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	sizeUpdateAllowed := true // only at the start of a block
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed field
+			idx, n, err := readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f, ok := d.table.lookup(idx)
+			if !ok {
+				return nil, fmt.Errorf("%w: no entry %d", ErrCompression, idx)
+			}
+			fields = append(fields, f)
+		case b&0xc0 == 0x40: // literal, added to the table
+			f, n, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			d.table.add(f)
+			fields = append(fields, f)
+		case b&0xe0 == 0x20: // table size update
+			if !sizeUpdateAllowed {
+				return nil, fmt.Errorf("%w: table size update mid-block", ErrCompression)
+			}
+			size, n, err := readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			if size > uint64(d.maxTableSize) {
+				return nil, fmt.Errorf("%w: table size %d over %d", ErrCompression, size, d.maxTableSize)
+			}
+			d.table.setMaxSize(uint32(size))
+			continue
+		default: // literal not added to the table, 0001 never will be
+			f, n, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			block = block[n:]
+			f.Sensitive = b&0x10 != 0
+			fields = append(fields, f)
+		}
+		sizeUpdateAllowed = false
+	}
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(p []byte, prefix uint8) (HeaderField, int, error) {
+	idx, n, err := readInt(p, prefix)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	var f HeaderField
+	if idx == 0 {
+		name, m, err := readString(p[n:])
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = name
+		n += m
+	} else {
+		indexed, ok := d.table.lookup(idx)
+		if !ok {
+			return HeaderField{}, 0, fmt.Errorf("%w: no entry %d", ErrCompression, idx)
+		}
+		f.Name = indexed.Name
+	}
+	value, m, err := readString(p[n:])
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	f.Value = value
+	return f, n + m, nil
+}
+
+// RFC 7541 5.1, the rest of the first byte's bits are the representation.
+func readInt(p []byte, prefix uint8) (uint64, int, error) {
+	if len(p) == 0 {
+		return 0, 0, fmt.Errorf("%w: truncated integer", ErrCompression)
+	}
+	max := uint64(1)<<prefix - 1
+	v := uint64(p[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+	for i, shift := 1, uint(0); i < len(p); i, shift = i+1, shift+7 {
+		if shift > 28 {
+			return 0, 0, fmt.Errorf("%w: integer too large", ErrCompression)
+		}
+		v += uint64(p[i]&0x7f) << shift
+		if p[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: truncated integer", ErrCompression)
+}
+
+// RFC 7541 5.2.
+func readString(p []byte) (string, int, error) {
+	if len(p) == 0 {
+		return "", 0, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	huffman := p[0]&0x80 != 0
+	length, n, err := readInt(p, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(p)-n) < length {
+		return "", 0, fmt.Errorf("%w: truncated string", ErrCompression)
+	}
+	raw := p[n : n+int(length)]
+	if !huffman {
+		return string(raw), n + int(length), nil
+	}
+	s, err := huffmanDecode(raw)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %w", ErrCompression, err)
+	}
+	return s, n + int(length), nil
+}
+
+// Encoder encodes header blocks for the peer's Decoder.
+type Encoder struct {
+	table dynamicTable
+	// the table was resized since the last block, the decoder has to be
+	// told the smallest size it went through and then where it ended up
+	sizeUpdate  bool
+	minSizeSeen uint32
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{table: dynamicTable{maxSize: defaultTableSize}}
+}
+
+// SetMaxTableSize takes the peer's SETTINGS_HEADER_TABLE_SIZE. The encoder
+// doesn't go over the default size even if it's allowed more.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, defaultTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.sizeUpdate || n < e.minSizeSeen {
+		e.minSizeSeen = n
+	}
+	e.sizeUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode encodes fields as one header block.
+func (e *Encoder) Encode(fields []HeaderField) []byte {
+	var buf []byte
+	if e.sizeUpdate {
+		if e.minSizeSeen < e.table.maxSize {
+			buf = appendInt(buf, 5, 0x20, uint64(e.minSizeSeen))
+		}
+		buf = appendInt(buf, 5, 0x20, uint64(e.table.maxSize))
+		e.sizeUpdate = false
+	}
+	for _, f := range fields {
+		idx, exact := e.table.search(f)
+		switch {
+		case exact && !f.Sensitive:
+			buf = appendInt(buf, 7, 0x80, idx)
+		case f.Sensitive:
+			buf = appendLiteral(buf, 4, 0x10, idx, f)
+		case f.size() > e.table.maxSize:
+			// adding it would just empty the table
+			buf = appendLiteral(buf, 4, 0x00, idx, f)
+		default:
+			buf = appendLiteral(buf, 6, 0x40, idx, f)
+			e.table.add(f)
+		}
+	}
+	return buf
+}
+
+func appendLiteral(buf []byte, prefix uint8, pattern byte, nameIdx uint64, f HeaderField) []byte {
+	buf = appendInt(buf, prefix, pattern, nameIdx)
+	if nameIdx == 0 {
+		buf = appendString(buf, f.Name)
+	}
+	return appendString(buf, f.Value)
+}
+
+func appendInt(buf []byte, prefix uint8, pattern byte, v uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if v < max {
+		return append(buf, pattern|byte(v))
+	}
+	buf = append(buf, pattern|byte(max))
+	for v -= max; v >= 0x80; v >>= 7 {
+		buf = append(buf, byte(v)|0x80)
+	}
+	return append(buf, byte(v))
+}
+
+// Huffman encoded when that's shorter.
+func appendString(buf []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		buf = appendInt(buf, 7, 0x80, uint64(n))
+		return appendHuffman(buf, s)
+	}
+	buf = appendInt(buf, 7, 0x00, uint64(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,164 @@
+package http2
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return b
+}
+
+func fields(pairs ...string) []HeaderField {
+	var f []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		f = append(f, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return f
+}
+
+func TestHPACKIntegers(t *testing.T) {
+	// Test: RFC 7541 C.1
+	assert.Equal(t, []byte{0x0a}, appendInt(nil, 5, 0, 10))
+	assert.Equal(t, []byte{0x1f, 0x9a, 0x0a}, appendInt(nil, 5, 0, 1337))
+	assert.Equal(t, []byte{0x2a}, appendInt(nil, 8, 0, 42))
+	v, n, err := readInt([]byte{0x1f, 0x9a, 0x0a}, 5)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1337), v)
+	assert.Equal(t, 3, n)
+
+	// Test: truncated and oversized
+	_, _, err = readInt([]byte{0x1f, 0x9a}, 5)
+	assert.ErrorIs(t, err, ErrCompression)
+	_, _, err = readInt([]byte{0x1f, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, 5)
+	assert.ErrorIs(t, err, ErrCompression)
+}
+
+// RFC 7541 C.3 and C.4, the same requests without and with Huffman coding.
+var requestBlocks = []struct {
+	plain, huffman string
+	fields         []HeaderField
+}{
+	{
+		"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+	},
+	{
+		"8286 84be 5808 6e6f 2d63 6163 6865",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com",
+			"cache-control", "no-cache"),
+	},
+	{
+		"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com",
+			"custom-key", "custom-value"),
+	},
+}
+
+func TestHPACKRequests(t *testing.T) {
+	// Test: decoding with and without Huffman, the table carries over
+	plain, huffman := NewDecoder(), NewDecoder()
+	for _, block := range requestBlocks {
+		got, err := plain.Decode(unhex(t, block.plain))
+		require.NoError(t, err)
+		assert.Equal(t, block.fields, got)
+		got, err = huffman.Decode(unhex(t, block.huffman))
+		require.NoError(t, err)
+		assert.Equal(t, block.fields, got)
+	}
+	assert.Equal(t, uint32(164), plain.table.size)
+	assert.Equal(t, uint32(164), huffman.table.size)
+
+	// Test: the encoder picks the same representations as the RFC
+	enc := NewEncoder()
+	for _, block := range requestBlocks {
+		assert.Equal(t, unhex(t, block.huffman), enc.Encode(block.fields))
+	}
+}
+
+func TestHPACKEviction(t *testing.T) {
+	// Test: RFC 7541 C.5, responses with a 256 byte table
+	d := NewDecoder()
+	d.table.setMaxSize(256)
+	got, err := d.Decode(unhex(t, "4803 3330 3258 0770 7269 7661 7465 611d"+
+		"4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3120 474d 546e 1768"+
+		"7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":status", "302", "cache-control", "private",
+		"date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"), got)
+	assert.Equal(t, uint32(222), d.table.size)
+
+	got, err = d.Decode(unhex(t, "4803 3330 37c1 c0bf"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":status", "307", "cache-control", "private",
+		"date", "Mon, 21 Oct 2013 20:13:21 GMT", "location", "https://www.example.com"), got)
+	assert.Equal(t, uint32(222), d.table.size)
+	assert.Len(t, d.table.fields, 4, "the 302 was evicted")
+
+	// Test: an index past the table
+	_, err = d.Decode([]byte{0x80 | 70})
+	assert.ErrorIs(t, err, ErrCompression)
+}
+
+func TestHPACKSizeUpdates(t *testing.T) {
+	// Test: only allowed at the start of a block, and within our limit
+	d := NewDecoder()
+	_, err := d.Decode([]byte{0x20, 0x82})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), d.table.maxSize)
+	_, err = d.Decode([]byte{0x82, 0x20})
+	assert.ErrorIs(t, err, ErrCompression)
+	_, err = d.Decode(appendInt(nil, 5, 0x20, defaultTableSize+1))
+	assert.ErrorIs(t, err, ErrCompression)
+
+	// Test: the encoder announces the smallest size, then the new one
+	e := NewEncoder()
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(1000)
+	block := e.Encode(fields(":method", "GET"))
+	assert.Equal(t, append(append(appendInt(nil, 5, 0x20, 0), appendInt(nil, 5, 0x20, 1000)...), 0x82), block)
+	d = NewDecoder()
+	got, err := d.Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET"), got)
+
+	// Test: sensitive fields stay out of the table
+	e = NewEncoder()
+	block = e.Encode([]HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}})
+	assert.Empty(t, e.table.fields)
+	got, err = NewDecoder().Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}}, got)
+}
+
+func TestHuffman(t *testing.T) {
+	// Test: every byte round trips
+	var all strings.Builder
+	for i := range 256 {
+		all.WriteByte(byte(i))
+	}
+	for _, s := range []string{"", "www.example.com", "no-cache", all.String()} {
+		got, err := huffmanDecode(appendHuffman(nil, s))
+		require.NoError(t, err)
+		assert.Equal(t, s, got)
+		assert.Len(t, appendHuffman(nil, s), huffmanEncodedLen(s))
+	}
+
+	// Test: padding has to be short and all ones
+	_, err := huffmanDecode([]byte{0xff, 0xff})
+	assert.ErrorIs(t, err, errInvalidHuffman)
+	_, err = huffmanDecode([]byte{0x00}) // '0' plus zero bits of padding
+	assert.ErrorIs(t, err, errInvalidHuffman)
+	_, err = huffmanDecode([]byte{0x07})
+	assert.NoError(t, err)
+}
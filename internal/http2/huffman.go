@@ -0,0 +1,87 @@
+package http2
+
+import "errors"
+
+var errInvalidHuffman = errors.New("invalid Huffman-encoded string")
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	sym      byte
+	leaf     bool
+}
+
+// The decoding tree, one level per bit. EOS isn't in it, running into its
+// code is an error like any other sequence that doesn't end on a symbol.
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := root
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := (code >> i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.sym = byte(sym)
+		n.leaf = true
+	}
+	return root
+}
+
+// RFC 7541 5.2: the string is padded to a byte with the start of EOS, all
+// ones, and anything else at the end is an error.
+func huffmanDecode(p []byte) (string, error) {
+	out := make([]byte, 0, len(p)*8/5)
+	n := huffmanRoot
+	padBits, allOnes := 0, true
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", errInvalidHuffman
+			}
+			padBits++
+			allOnes = allOnes && bit == 1
+			if n.leaf {
+				out = append(out, n.sym)
+				n = huffmanRoot
+				padBits, allOnes = 0, true
+			}
+		}
+	}
+	if padBits > 7 || !allOnes {
+		return "", errInvalidHuffman
+	}
+	return string(out), nil
+}
+
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLen[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		acc = acc<<huffmanCodeLen[s[i]] | uint64(huffmanCodes[s[i]])
+		bits += int(huffmanCodeLen[s[i]])
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+		acc &= 1<<bits - 1
+	}
+	if bits > 0 {
+		pad := 8 - bits
+		dst = append(dst, byte(acc<<pad|(1<<pad-1)))
+	}
+	return dst
+}
@@ -0,0 +1,893 @@
+// Package http2 serves HTTP/2 over cleartext TCP (h2c), RFC 9113, either
+// with prior knowledge or upgraded from an HTTP/1.1 request. Every stream
+// is handed to a Handler with a response.Writer, like an HTTP/1 request.
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientPreface starts every HTTP/2 connection, it's how a client with
+// prior knowledge is told apart from an HTTP/1 one.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Handler is server.Handler, which can't be used here without an import
+// cycle.
+type Handler func(w *response.Writer, req *request.Request)
+
+// DefaultMaxConcurrentStreams is how many streams a client may have open
+// unless Config says otherwise.
+const DefaultMaxConcurrentStreams = 100
+
+// The stream flow control window we start with and never change. The
+// connection window is given back as soon as data arrives, a stream's as
+// its handler reads the body.
+const initialWindowSize = 65535
+
+type Config struct {
+	// MaxConcurrentStreams caps how many streams a client may have open
+	// at once, a stream it reset still counts until its handler returns.
+	// Zero means DefaultMaxConcurrentStreams.
+	MaxConcurrentStreams uint32
+	// Limits caps the header list of a request, past MaxHeaderBytes or
+	// MaxHeaderCount it's answered with a 431, and its body. Zero fields
+	// use request.DefaultLimits, Strict doesn't apply.
+	Limits request.Limits
+	// IdleTimeout closes a connection without open streams after that
+	// long. Zero means no limit.
+	IdleTimeout time.Duration
+	// ConnState, if set, is told when the last open stream is done and
+	// when a new one opens, so the caller knows when it's safe to close.
+	ConnState func(idle bool)
+	// Shutdown, if set, is closed to wind the connection down: the client
+	// gets a GOAWAY, streams it opens after that are refused and ServeConn
+	// returns once the open ones are done.
+	Shutdown <-chan struct{}
+}
+
+func (c Config) maxConcurrentStreams() uint32 {
+	if c.MaxConcurrentStreams == 0 {
+		return DefaultMaxConcurrentStreams
+	}
+	return c.MaxConcurrentStreams
+}
+
+// ServeConn speaks HTTP/2 on conn until the client goes away, the
+// connection fails, IdleTimeout passes or Shutdown is closed. r reads what the client sent,
+// starting with ClientPreface, in case some of it was already read off
+// conn. It returns once every handler is done, and leaves closing conn to
+// the caller.
+func ServeConn(conn net.Conn, r io.Reader, handler Handler, config Config) error {
+	return newServerConn(conn, r, handler, config).serve(nil)
+}
+
+// IsUpgrade reports whether req asks to upgrade to h2c, RFC 7540 3.2. Its
+// body has to be read before the connection is handed to ServeUpgrade.
+func IsUpgrade(req *request.Request) bool {
+	if req.RequestLine.HttpVersion != "1.1" || !req.Headers.HasToken("Upgrade", "h2c") ||
+		!req.Headers.HasToken("Connection", "upgrade") || !req.Headers.HasToken("Connection", "http2-settings") {
+		return false
+	}
+	_, err := upgradeSettings(req)
+	return err == nil
+}
+
+// ServeUpgrade is ServeConn for a connection upgraded with req, which
+// IsUpgrade has to have said yes to. It answers with a 101 and the response
+// to req goes out on stream 1.
+func ServeUpgrade(conn net.Conn, r io.Reader, handler Handler, config Config, req *request.Request) error {
+	settings, err := upgradeSettings(req)
+	if err != nil {
+		return err
+	}
+	sc := newServerConn(conn, r, handler, config)
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"); err != nil {
+		return err
+	}
+	return sc.serve(req)
+}
+
+// The HTTP2-Settings field is a SETTINGS payload in base64url.
+func upgradeSettings(req *request.Request) ([]Setting, error) {
+	values := req.Headers.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, fmt.Errorf("want one HTTP2-Settings, got %d", len(values))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(values[0]), "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP2-Settings: %w", err)
+	}
+	return parseSettings(payload)
+}
+
+var (
+	errConnClosed   = errors.New("http2: connection closed")
+	errStreamClosed = errors.New("http2: stream closed")
+)
+
+// How many of the streams it reset the server remembers, to ignore what
+// the client had already sent on them.
+const maxResetStreams = 1 << 10
+
+// A client resetting more than maxClientResets streams within
+// clientResetWindow is taken for a rapid reset attack (CVE-2023-44487),
+// opening streams and cancelling them right away to get handlers started
+// without end. It's sent away with ENHANCE_YOUR_CALM.
+const (
+	maxClientResets   = 100
+	clientResetWindow = time.Second
+)
+
+type serverConn struct {
+	conn     net.Conn
+	r        io.Reader
+	handler  Handler
+	config   Config
+	limits   request.Limits
+	handlers sync.WaitGroup
+
+	// only touched by the read loop
+	dec             *Decoder
+	headerStream    uint32 // a header block waiting on CONTINUATION frames
+	headerEndStream bool
+	headerBuf       []byte
+	clientResets    int // RST_STREAMs from the client since resetsSince
+	resetsSince     time.Time
+
+	// wmu keeps frames whole on the wire and header blocks encoded in the
+	// order they're sent, the peer's decoder depends on it
+	wmu sync.Mutex
+	enc *Encoder
+
+	mu                sync.Mutex
+	cond              *sync.Cond // flow control windows opened, or streams closed
+	streams           map[uint32]*stream
+	lastStreamID      uint32
+	sendWindow        int64 // connection level
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	goingAway         bool // no new streams, the connection ends once they're done
+	closed            bool
+	// streams this end reset, oldest first. Frames may still be on their
+	// way, RFC 9113 5.1 says to ignore them.
+	resetIDs []uint32
+	// handlers still running on streams that were reset, by either end.
+	// They count against MaxConcurrentStreams until they return, or a
+	// client could start any number of them by resetting each stream it
+	// opens.
+	resetRunning int
+}
+
+func newServerConn(conn net.Conn, r io.Reader, handler Handler, config Config) *serverConn {
+	limits := config.Limits
+	if limits.MaxHeaderBytes <= 0 {
+		limits.MaxHeaderBytes = request.DefaultLimits.MaxHeaderBytes
+	}
+	if limits.MaxHeaderCount <= 0 {
+		limits.MaxHeaderCount = request.DefaultLimits.MaxHeaderCount
+	}
+	sc := &serverConn{
+		conn:              conn,
+		r:                 bufio.NewReader(r),
+		handler:           handler,
+		config:            config,
+		limits:            limits,
+		dec:               NewDecoder(),
+		enc:               NewEncoder(),
+		streams:           map[uint32]*stream{},
+		sendWindow:        initialWindowSize,
+		peerInitialWindow: initialWindowSize,
+		peerMaxFrameSize:  defaultMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	return sc
+}
+
+// The read loop, frames are handled in the order they come in and only
+// handlers run on their own goroutines. upgrade is the request of an
+// upgraded connection, answered on stream 1.
+func (sc *serverConn) serve(upgrade *request.Request) error {
+	defer sc.shutdown()
+	if sc.config.Shutdown != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-sc.config.Shutdown:
+				sc.shutdownGracefully()
+			case <-stop:
+			}
+		}()
+	}
+	sc.setIdleDeadline()
+	err := sc.writeFrame(settingsFrame(
+		Setting{SettingMaxConcurrentStreams, sc.config.maxConcurrentStreams()},
+		Setting{SettingMaxHeaderListSize, uint32(sc.limits.MaxHeaderBytes)},
+		Setting{SettingEnablePush, 0},
+	))
+	if err != nil {
+		return err
+	}
+	if upgrade != nil {
+		upgrade.BodyReader = io.NopCloser(bytes.NewReader(upgrade.Body))
+		sc.lastStreamID = 1
+		sc.startStream(1, true, -1, nil, func(w *response.Writer) {
+			w.SetMethod(upgrade.RequestLine.Method)
+			sc.handler(w, upgrade)
+		})
+	}
+
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.r, preface); err != nil {
+		return sc.connectionError(err)
+	}
+	if string(preface) != ClientPreface {
+		return fmt.Errorf("http2: invalid client preface %q", preface)
+	}
+	for first := true; ; first = false {
+		f, err := ReadFrame(sc.r, defaultMaxFrameSize)
+		if err != nil && sc.done() {
+			break // woken up by setIdle to end it
+		}
+		if err == nil && first && (f.Type != FrameSettings || f.Has(FlagAck)) {
+			err = connError(ErrCodeProtocol, "first frame isn't SETTINGS")
+		}
+		if err == nil {
+			err = sc.processFrame(f)
+		}
+		var se *StreamError
+		if errors.As(err, &se) {
+			sc.resetStream(se.StreamID, se.Code)
+			continue
+		}
+		if err != nil {
+			return sc.connectionError(err)
+		}
+		if sc.done() {
+			break
+		}
+	}
+	// the GOAWAY and the last frame of the last response may still be on
+	// their way out
+	sc.wmu.Lock()
+	sc.wmu.Unlock()
+	sc.handlers.Wait()
+	return nil
+}
+
+// Ends the connection over err, with a GOAWAY if it's the client's fault.
+// A client that just left or went quiet isn't an error.
+func (sc *serverConn) connectionError(err error) error {
+	var ce *ConnectionError
+	if errors.As(err, &ce) {
+		sc.goAway(ce.Code, ce.Reason)
+		return err
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		sc.goAway(ErrCodeNo, "idle")
+		return nil
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// The GOAWAY goes out under wmu, so once the read loop sees goingAway it
+// can wait for the frame to be written by taking wmu.
+func (sc *serverConn) goAway(code ErrCode, debug string) {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	sc.mu.Lock()
+	last := sc.lastStreamID
+	sc.goingAway = true
+	sc.mu.Unlock()
+	WriteFrame(sc.conn, goAwayFrame(last, code, debug))
+}
+
+// The connection is told to wind down: the client gets a GOAWAY with the
+// last stream that will be answered, and the read loop ends as soon as
+// there's no stream left.
+func (sc *serverConn) shutdownGracefully() {
+	sc.goAway(ErrCodeNo, "shutdown")
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if len(sc.streams) == 0 {
+		sc.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Whether the connection is going away and the last stream is done.
+func (sc *serverConn) done() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.goingAway && len(sc.streams) == 0
+}
+
+// Wakes up every handler stuck on the connection and waits for them.
+func (sc *serverConn) shutdown() {
+	sc.mu.Lock()
+	sc.closed = true
+	for _, st := range sc.streams {
+		st.body.closeWithError(errConnClosed)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	// a handler stuck writing to a client that stopped reading would hold
+	// this up forever
+	sc.conn.SetWriteDeadline(time.Now())
+	sc.handlers.Wait()
+}
+
+func (sc *serverConn) processFrame(f Frame) error {
+	if sc.headerStream != 0 && (f.Type != FrameContinuation || f.StreamID != sc.headerStream) {
+		return connError(ErrCodeProtocol, "expected CONTINUATION for stream %d", sc.headerStream)
+	}
+	switch f.Type {
+	case FrameData:
+		return sc.processData(f)
+	case FrameHeaders:
+		return sc.processHeaders(f)
+	case FrameContinuation:
+		return sc.processContinuation(f)
+	case FramePriority:
+		if f.StreamID == 0 {
+			return connError(ErrCodeProtocol, "PRIORITY on stream 0")
+		}
+		if len(f.Payload) != 5 {
+			return streamError(f.StreamID, ErrCodeFrameSize, "PRIORITY of %d bytes", len(f.Payload))
+		}
+		return nil // deprecated, RFC 9113 5.3.2
+	case FrameRSTStream:
+		return sc.processRSTStream(f)
+	case FrameSettings:
+		return sc.processSettings(f)
+	case FramePushPromise:
+		return connError(ErrCodeProtocol, "clients can't push")
+	case FramePing:
+		return sc.processPing(f)
+	case FrameGoAway:
+		if f.StreamID != 0 {
+			return connError(ErrCodeProtocol, "GOAWAY on stream %d", f.StreamID)
+		}
+		if len(f.Payload) < 8 {
+			return connError(ErrCodeFrameSize, "GOAWAY of %d bytes", len(f.Payload))
+		}
+		// the client is leaving, let the streams it has open finish
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+		return nil
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(f)
+	}
+	return nil // unknown frame types are ignored
+}
+
+// lookup returns the stream with id, or a nil one and whether it's idle,
+// not opened yet as opposed to closed already.
+func (sc *serverConn) lookup(id uint32) (*stream, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streams[id], id > sc.lastStreamID
+}
+
+func (sc *serverConn) processData(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "DATA on stream 0")
+	}
+	data, err := unpad(f)
+	if err != nil {
+		return err
+	}
+	// the connection window is given straight back, each stream's own
+	// window is what keeps a slow handler from being flooded
+	if len(f.Payload) > 0 {
+		sc.writeFrame(windowUpdateFrame(0, uint32(len(f.Payload))))
+	}
+	st, idle := sc.lookup(f.StreamID)
+	if st == nil {
+		if idle {
+			return connError(ErrCodeProtocol, "DATA on idle stream %d", f.StreamID)
+		}
+		if sc.wasReset(f.StreamID) {
+			return nil
+		}
+		return streamError(f.StreamID, ErrCodeStreamClosed, "DATA on closed stream")
+	}
+
+	sc.mu.Lock()
+	recvClosed := st.recvClosed
+	st.recvWindow -= int64(len(f.Payload))
+	overflow := st.recvWindow < 0
+	sc.mu.Unlock()
+	if recvClosed {
+		return streamError(st.id, ErrCodeStreamClosed, "DATA after END_STREAM")
+	}
+	if overflow {
+		return streamError(st.id, ErrCodeFlowControl, "DATA past the flow control window")
+	}
+	if pad := len(f.Payload) - len(data); pad > 0 {
+		sc.giveBack(st, pad)
+	}
+
+	st.received += int64(len(data))
+	if st.declaredLength >= 0 && st.received > st.declaredLength {
+		return streamError(st.id, ErrCodeProtocol, "body longer than its content-length")
+	}
+	if max := sc.limits.MaxBodyBytes; max > 0 && st.received > max {
+		st.body.closeWithError(request.ErrBodyTooLarge)
+	}
+	if len(data) > 0 && !st.body.write(data) {
+		sc.giveBack(st, len(data)) // nobody's reading it
+	}
+	if f.Has(FlagEndStream) {
+		return sc.endOfBody(st)
+	}
+	return nil
+}
+
+// The client is done sending on st.
+func (sc *serverConn) endOfBody(st *stream) error {
+	if st.declaredLength >= 0 && st.received != st.declaredLength {
+		return streamError(st.id, ErrCodeProtocol, "body of %d bytes, content-length says %d", st.received, st.declaredLength)
+	}
+	st.body.closeWithError(io.EOF)
+	sc.mu.Lock()
+	st.recvClosed = true
+	done := st.sendClosed
+	sc.mu.Unlock()
+	if done {
+		sc.removeStream(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processHeaders(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "HEADERS on stream 0")
+	}
+	block, err := headerBlock(f)
+	if err != nil {
+		return err
+	}
+	if f.Has(FlagEndHeaders) {
+		return sc.processHeaderBlock(f.StreamID, block, f.Has(FlagEndStream))
+	}
+	sc.headerStream = f.StreamID
+	sc.headerEndStream = f.Has(FlagEndStream)
+	sc.headerBuf = append(sc.headerBuf[:0], block...)
+	return nil
+}
+
+func (sc *serverConn) processContinuation(f Frame) error {
+	if sc.headerStream == 0 {
+		return connError(ErrCodeProtocol, "CONTINUATION without HEADERS")
+	}
+	sc.headerBuf = append(sc.headerBuf, f.Payload...)
+	if len(sc.headerBuf) > sc.limits.MaxHeaderBytes {
+		// it has to be decoded to keep the table in step, no point
+		return connError(ErrCodeEnhanceYourCalm, "header block over %d bytes", sc.limits.MaxHeaderBytes)
+	}
+	if !f.Has(FlagEndHeaders) {
+		return nil
+	}
+	id := sc.headerStream
+	sc.headerStream = 0
+	return sc.processHeaderBlock(id, sc.headerBuf, sc.headerEndStream)
+}
+
+func (sc *serverConn) processHeaderBlock(id uint32, block []byte, endStream bool) error {
+	// decoded whatever happens to the stream, or the tables drift apart
+	fields, err := sc.dec.Decode(block)
+	if err != nil {
+		return connError(ErrCodeCompression, "%v", err)
+	}
+
+	st, idle := sc.lookup(id)
+	if st != nil {
+		return sc.processTrailers(st, fields, endStream)
+	}
+	if !idle {
+		if sc.wasReset(id) {
+			return nil // decoded above, so the table is still in step
+		}
+		return connError(ErrCodeStreamClosed, "HEADERS on closed stream %d", id)
+	}
+	if id%2 == 0 {
+		return connError(ErrCodeProtocol, "client opened even stream %d", id)
+	}
+	sc.mu.Lock()
+	sc.lastStreamID = id
+	goingAway := sc.goingAway
+	full := uint32(len(sc.streams)+sc.resetRunning) >= sc.config.maxConcurrentStreams()
+	sc.mu.Unlock()
+	if goingAway {
+		// past the GOAWAY's last stream, the client can retry it elsewhere
+		return streamError(id, ErrCodeRefusedStream, "going away")
+	}
+	if full {
+		return streamError(id, ErrCodeRefusedStream, "over %d concurrent streams", sc.config.maxConcurrentStreams())
+	}
+
+	req, declaredLength, err := sc.newRequest(id, fields)
+	if errors.Is(err, request.ErrHeaderTooLarge) || errors.Is(err, request.ErrTooManyHeaders) {
+		sc.startStream(id, endStream, -1, nil, func(w *response.Writer) {
+			writeStatus(w, response.StatusCodeHeaderTooLarge)
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if endStream && declaredLength > 0 {
+		return streamError(id, ErrCodeProtocol, "no body, content-length says %d", declaredLength)
+	}
+	sc.startStream(id, endStream, declaredLength, req, func(w *response.Writer) {
+		w.SetMethod(req.RequestLine.Method)
+		sc.handler(w, req)
+	})
+	return nil
+}
+
+// RFC 9113 8.1: a second header block ends the stream as its trailers.
+func (sc *serverConn) processTrailers(st *stream, fields []HeaderField, endStream bool) error {
+	sc.mu.Lock()
+	recvClosed := st.recvClosed
+	sc.mu.Unlock()
+	if recvClosed {
+		return streamError(st.id, ErrCodeStreamClosed, "HEADERS after END_STREAM")
+	}
+	if !endStream {
+		return streamError(st.id, ErrCodeProtocol, "trailers without END_STREAM")
+	}
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			return streamError(st.id, ErrCodeProtocol, "pseudo-header %s in trailers", f.Name)
+		}
+		if err := validateField(st.id, f); err != nil {
+			return err
+		}
+		if request.TrailerRefused(f.Name) {
+			return streamError(st.id, ErrCodeProtocol, "%s in trailers", f.Name)
+		}
+		if st.req != nil && request.TrailerAllowed(f.Name) {
+			st.req.Trailers.Add(f.Name, f.Value)
+		}
+	}
+	return sc.endOfBody(st)
+}
+
+// Opens stream id and runs handle on it. What the client sends on the
+// stream from here on is req's body, or dropped if there's no req.
+func (sc *serverConn) startStream(id uint32, endStream bool, declaredLength int64, req *request.Request, handle func(w *response.Writer)) {
+	st := &stream{
+		sc:             sc,
+		id:             id,
+		req:            req,
+		recvWindow:     initialWindowSize,
+		recvClosed:     endStream,
+		declaredLength: declaredLength,
+	}
+	st.body = newPipe(func(n int) { sc.giveBack(st, n) })
+	if endStream {
+		st.body.closeWithError(io.EOF)
+	}
+	if req != nil {
+		req.BodyReader = st.body
+	} else {
+		st.body.Close()
+	}
+	sc.mu.Lock()
+	st.sendWindow = sc.peerInitialWindow
+	sc.streams[id] = st
+	if len(sc.streams) == 1 {
+		sc.setBusy()
+	}
+	sc.mu.Unlock()
+
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		w := response.NewStreamWriter(st)
+		handle(w)
+		w.Finish()
+		st.body.Close()
+		sc.closeSend(st)
+	}()
+}
+
+// Gives n bytes of st's window back once they're off its hands.
+func (sc *serverConn) giveBack(st *stream, n int) {
+	if n <= 0 {
+		return
+	}
+	sc.mu.Lock()
+	open := !st.recvClosed && !st.reset
+	if open {
+		st.recvWindow += int64(n)
+	}
+	sc.mu.Unlock()
+	if open {
+		sc.writeFrame(windowUpdateFrame(st.id, uint32(n)))
+	}
+}
+
+// The response on st is done. If the client is still sending it's told to
+// stop, RFC 9113 8.1 allows that once the response is complete.
+func (sc *serverConn) closeSend(st *stream) {
+	sc.mu.Lock()
+	st.sendClosed = true
+	st.handled = true
+	if st.reset {
+		sc.resetRunning--
+	}
+	stillSending := !st.recvClosed && !st.reset
+	sc.mu.Unlock()
+	if stillSending {
+		sc.resetStream(st.id, ErrCodeNo)
+		return
+	}
+	sc.removeStream(st)
+}
+
+// Sends a RST_STREAM and forgets the stream, its handler's writes fail
+// from here on.
+func (sc *serverConn) resetStream(id uint32, code ErrCode) {
+	sc.writeFrame(rstStreamFrame(id, code))
+	sc.mu.Lock()
+	if !slices.Contains(sc.resetIDs, id) {
+		if len(sc.resetIDs) == maxResetStreams {
+			sc.resetIDs = sc.resetIDs[1:]
+		}
+		sc.resetIDs = append(sc.resetIDs, id)
+	}
+	sc.mu.Unlock()
+	st, _ := sc.lookup(id)
+	if st != nil {
+		sc.forgetReset(st)
+	}
+}
+
+// Forgets st once either end reset it, its handler's writes fail from here
+// on. The handler keeps counting against MaxConcurrentStreams until it
+// returns.
+func (sc *serverConn) forgetReset(st *stream) {
+	sc.mu.Lock()
+	if !st.reset && !st.handled {
+		sc.resetRunning++
+	}
+	st.reset = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	st.body.closeWithError(errStreamClosed)
+	sc.removeStream(st)
+}
+
+// Whether id is a stream this end reset, as far as it remembers.
+func (sc *serverConn) wasReset(id uint32) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return slices.Contains(sc.resetIDs, id)
+}
+
+func (sc *serverConn) removeStream(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.streams[st.id]; !ok {
+		return
+	}
+	delete(sc.streams, st.id)
+	if len(sc.streams) == 0 {
+		sc.setIdle()
+	}
+}
+
+// Called with mu held as the first stream opens and the last one closes.
+func (sc *serverConn) setBusy() {
+	sc.conn.SetReadDeadline(time.Time{})
+	if sc.config.ConnState != nil {
+		sc.config.ConnState(false)
+	}
+}
+
+func (sc *serverConn) setIdle() {
+	if sc.goingAway {
+		// nothing left to wait for, wake up the read loop to end it
+		sc.conn.SetReadDeadline(time.Now())
+	} else {
+		sc.setIdleDeadline()
+	}
+	if sc.config.ConnState != nil {
+		sc.config.ConnState(true)
+	}
+}
+
+func (sc *serverConn) setIdleDeadline() {
+	if sc.config.IdleTimeout > 0 {
+		sc.conn.SetReadDeadline(time.Now().Add(sc.config.IdleTimeout))
+	}
+}
+
+func (sc *serverConn) processRSTStream(f Frame) error {
+	if f.StreamID == 0 {
+		return connError(ErrCodeProtocol, "RST_STREAM on stream 0")
+	}
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "RST_STREAM of %d bytes", len(f.Payload))
+	}
+	st, idle := sc.lookup(f.StreamID)
+	if idle {
+		return connError(ErrCodeProtocol, "RST_STREAM on idle stream %d", f.StreamID)
+	}
+	if err := sc.countClientReset(); err != nil {
+		return err
+	}
+	if st != nil {
+		sc.forgetReset(st)
+	}
+	return nil
+}
+
+// Keeps count of the streams the client resets, see maxClientResets.
+func (sc *serverConn) countClientReset() error {
+	now := time.Now()
+	if now.Sub(sc.resetsSince) > clientResetWindow {
+		sc.clientResets, sc.resetsSince = 0, now
+	}
+	sc.clientResets++
+	if sc.clientResets > maxClientResets {
+		return connError(ErrCodeEnhanceYourCalm, "over %d streams reset in %v", maxClientResets, clientResetWindow)
+	}
+	return nil
+}
+
+func (sc *serverConn) processSettings(f Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "SETTINGS on stream %d", f.StreamID)
+	}
+	if f.Has(FlagAck) {
+		if len(f.Payload) != 0 {
+			return connError(ErrCodeFrameSize, "SETTINGS ack with a payload")
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.Payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	return sc.writeFrame(Frame{Type: FrameSettings, Flags: FlagAck})
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			sc.wmu.Lock()
+			sc.enc.SetMaxTableSize(s.Val)
+			sc.wmu.Unlock()
+		case SettingEnablePush:
+			if s.Val > 1 {
+				return connError(ErrCodeProtocol, "SETTINGS_ENABLE_PUSH of %d", s.Val)
+			}
+		case SettingInitialWindowSize:
+			if s.Val > maxWindowSize {
+				return connError(ErrCodeFlowControl, "SETTINGS_INITIAL_WINDOW_SIZE of %d", s.Val)
+			}
+			if err := sc.setInitialWindow(int64(s.Val)); err != nil {
+				return err
+			}
+		case SettingMaxFrameSize:
+			if s.Val < defaultMaxFrameSize || s.Val > maxFrameSizeLimit {
+				return connError(ErrCodeProtocol, "SETTINGS_MAX_FRAME_SIZE of %d", s.Val)
+			}
+			sc.mu.Lock()
+			sc.peerMaxFrameSize = s.Val
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// RFC 9113 6.9.2: a new initial window size shifts the window of every
+// open stream by the difference.
+func (sc *serverConn) setInitialWindow(size int64) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delta := size - sc.peerInitialWindow
+	sc.peerInitialWindow = size
+	for _, st := range sc.streams {
+		st.sendWindow += delta
+		if st.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "stream %d window over the limit", st.id)
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processPing(f Frame) error {
+	if f.StreamID != 0 {
+		return connError(ErrCodeProtocol, "PING on stream %d", f.StreamID)
+	}
+	if len(f.Payload) != 8 {
+		return connError(ErrCodeFrameSize, "PING of %d bytes", len(f.Payload))
+	}
+	if f.Has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(Frame{Type: FramePing, Flags: FlagAck, Payload: f.Payload})
+}
+
+func (sc *serverConn) processWindowUpdate(f Frame) error {
+	if len(f.Payload) != 4 {
+		return connError(ErrCodeFrameSize, "WINDOW_UPDATE of %d bytes", len(f.Payload))
+	}
+	increment := int64(binary.BigEndian.Uint32(f.Payload) & (1<<31 - 1))
+	if f.StreamID == 0 {
+		if increment == 0 {
+			return connError(ErrCodeProtocol, "WINDOW_UPDATE of 0")
+		}
+		sc.mu.Lock()
+		defer sc.mu.Unlock()
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError(ErrCodeFlowControl, "connection window over the limit")
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	st, idle := sc.lookup(f.StreamID)
+	if idle {
+		return connError(ErrCodeProtocol, "WINDOW_UPDATE on idle stream %d", f.StreamID)
+	}
+	if st == nil {
+		return nil // it may have been closed while the client sent it
+	}
+	if increment == 0 {
+		return streamError(st.id, ErrCodeProtocol, "WINDOW_UPDATE of 0")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError(st.id, ErrCodeFlowControl, "window over the limit")
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) writeFrame(f Frame) error {
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	return WriteFrame(sc.conn, f)
+}
+
+// Answers with just a status, like the HTTP/1 server does for a request
+// it won't hand to the handler.
+func writeStatus(w *response.Writer, statusCode response.StatusCode) {
+	body := []byte(response.StatusText(statusCode))
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
@@ -0,0 +1,665 @@
+package http2
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClient speaks HTTP/2 to a serverConn over a net.Pipe. Frames are
+// read off on their own goroutine, the pipe doesn't buffer.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan Frame
+	enc    *Encoder
+	dec    *Decoder
+	served chan error
+}
+
+func newTestClient(t *testing.T, handler Handler, config Config, settings ...Setting) *testClient {
+	client, server := net.Pipe()
+	c := startTestClient(t, client)
+	c.readFrames(client)
+	go func() { c.served <- ServeConn(server, server, handler, config) }()
+	c.writeRaw([]byte(ClientPreface))
+	c.write(settingsFrame(settings...))
+	return c
+}
+
+func startTestClient(t *testing.T, conn net.Conn) *testClient {
+	c := &testClient{t: t, conn: conn, frames: make(chan Frame, 100), enc: NewEncoder(), dec: NewDecoder(), served: make(chan error, 1)}
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// readFrames starts reading what the server sends off r.
+func (c *testClient) readFrames(r io.Reader) {
+	go func() {
+		defer close(c.frames)
+		for {
+			f, err := ReadFrame(r, maxFrameSizeLimit)
+			if err != nil {
+				return
+			}
+			c.frames <- f
+		}
+	}()
+}
+
+func (c *testClient) writeRaw(p []byte) {
+	c.t.Helper()
+	_, err := c.conn.Write(p)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) write(f Frame) {
+	c.t.Helper()
+	c.writeRaw(appendFrame(nil, f))
+}
+
+// next returns the next frame that isn't SETTINGS or WINDOW_UPDATE, which
+// the tests mostly don't care about.
+func (c *testClient) next() Frame {
+	c.t.Helper()
+	for {
+		f := c.nextAny()
+		if f.Type != FrameSettings && f.Type != FrameWindowUpdate {
+			return f
+		}
+	}
+}
+
+func (c *testClient) nextAny() Frame {
+	c.t.Helper()
+	select {
+	case f, ok := <-c.frames:
+		require.True(c.t, ok, "connection closed")
+		return f
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("timed out waiting for a frame")
+		return Frame{}
+	}
+}
+
+func (c *testClient) headers(id uint32, endStream bool, pairs ...string) {
+	c.t.Helper()
+	f := Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: id, Payload: c.enc.Encode(fields(pairs...))}
+	if endStream {
+		f.Flags |= FlagEndStream
+	}
+	c.write(f)
+}
+
+func (c *testClient) get(id uint32, path string) {
+	c.t.Helper()
+	c.headers(id, true, ":method", "GET", ":scheme", "http", ":path", path, ":authority", "localhost")
+}
+
+type testResponse struct {
+	fields   []HeaderField
+	body     string
+	trailers []HeaderField
+}
+
+func (r testResponse) get(name string) string {
+	for _, f := range r.fields {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// response reads frames for stream id up to its END_STREAM.
+func (c *testClient) response(id uint32) testResponse {
+	c.t.Helper()
+	return c.responses(id)[id]
+}
+
+// responses reads the responses on streams ids, in whatever order their
+// frames come in.
+func (c *testClient) responses(ids ...uint32) map[uint32]testResponse {
+	c.t.Helper()
+	resps := map[uint32]testResponse{}
+	open := map[uint32]bool{}
+	for _, id := range ids {
+		open[id] = true
+	}
+	for len(open) > 0 {
+		f := c.next()
+		require.True(c.t, open[f.StreamID], "%v frame on stream %d", f.Type, f.StreamID)
+		resp := resps[f.StreamID]
+		switch f.Type {
+		case FrameHeaders:
+			block, err := headerBlock(f)
+			require.NoError(c.t, err)
+			decoded, err := c.dec.Decode(block)
+			require.NoError(c.t, err)
+			if resp.fields == nil {
+				resp.fields = decoded
+			} else {
+				resp.trailers = decoded
+			}
+		case FrameData:
+			resp.body += string(f.Payload)
+		default:
+			c.t.Fatalf("unexpected %v frame", f.Type)
+		}
+		resps[f.StreamID] = resp
+		if f.Has(FlagEndStream) {
+			delete(open, f.StreamID)
+		}
+	}
+	return resps
+}
+
+func (c *testClient) expectGoAway(code ErrCode) {
+	c.t.Helper()
+	f := c.next()
+	require.Equal(c.t, FrameGoAway, f.Type)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+}
+
+func (c *testClient) expectReset(id uint32, code ErrCode) {
+	c.t.Helper()
+	f := c.next()
+	require.Equal(c.t, FrameRSTStream, f.Type)
+	assert.Equal(c.t, id, f.StreamID)
+	assert.Equal(c.t, code, ErrCode(binary.BigEndian.Uint32(f.Payload)))
+}
+
+func echo(w *response.Writer, req *request.Request) {
+	body, err := io.ReadAll(req.BodyReader)
+	if err != nil {
+		w.WriteStatusLine(response.StatusCodeBadRequest)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+		return
+	}
+	host, _ := req.Headers.Get("Host")
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("X-Request", req.RequestLine.Method+" "+req.RequestLine.RequestTarget+" "+req.RequestLine.HttpVersion+" "+host)
+	for _, f := range req.Trailers.Fields() {
+		h.Add("X-Trailer", f.Name)
+	}
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+func TestServeConnGet(t *testing.T) {
+	c := newTestClient(t, echo, Config{})
+
+	// Test: the server's SETTINGS come first, and ours get an ack
+	f := c.nextAny()
+	require.Equal(t, FrameSettings, f.Type)
+	assert.False(t, f.Has(FlagAck))
+	f = c.nextAny()
+	require.Equal(t, FrameSettings, f.Type)
+	assert.True(t, f.Has(FlagAck))
+
+	// Test: a request without a body gets its response on the stream
+	c.get(1, "/hello?x=1")
+	resp := c.response(1)
+	assert.Equal(t, ":status", resp.fields[0].Name)
+	assert.Equal(t, "200", resp.get(":status"))
+	assert.Equal(t, "GET /hello?x=1 2.0 localhost", resp.get("x-request"))
+	assert.Equal(t, "0", resp.get("content-length"))
+	assert.Equal(t, "", resp.get("connection"))
+
+	// Test: the connection goes on with the next stream
+	c.get(3, "/again")
+	assert.Equal(t, "GET /again 2.0 localhost", c.response(3).get("x-request"))
+}
+
+func TestServeConnBody(t *testing.T) {
+	c := newTestClient(t, echo, Config{})
+
+	// Test: a body over several DATA frames, one of them padded
+	c.headers(1, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "11")
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: []byte("hello ")})
+	c.write(Frame{Type: FrameData, Flags: FlagPadded | FlagEndStream, StreamID: 1, Payload: []byte{2, 'w', 'o', 'r', 'l', 'd', 0, 0}})
+	resp := c.response(1)
+	assert.Equal(t, "hello world", resp.body)
+	assert.Equal(t, "11", resp.get("content-length"))
+
+	// Test: a body longer than its content-length resets the stream
+	c.headers(3, false, ":method", "POST", ":scheme", "http", ":path", "/", "content-length", "2")
+	c.write(Frame{Type: FrameData, Flags: FlagEndStream, StreamID: 3, Payload: []byte("abc")})
+	c.expectReset(3, ErrCodeProtocol)
+
+	// Test: a trailer that belongs in the header section resets it too
+	c.headers(5, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	c.write(Frame{Type: FrameData, StreamID: 5, Payload: []byte("abc")})
+	c.headers(5, true, "content-length", "3")
+	c.expectReset(5, ErrCodeProtocol)
+
+	// Test: other fields that don't belong in trailers are just dropped
+	c.headers(7, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	c.write(Frame{Type: FrameData, StreamID: 7, Payload: []byte("abc")})
+	c.headers(7, true, "cache-control", "no-cache", "x-sum", "1")
+	resp = c.response(7)
+	assert.Equal(t, "abc", resp.body)
+	assert.Equal(t, "x-sum", resp.get("x-trailer"))
+}
+
+func TestServeConnStreaming(t *testing.T) {
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		h.Set("Trailer", "X-Sum")
+		w.WriteHeaders(h)
+		w.Write([]byte("one "))
+		w.Flush()
+		w.Write([]byte("two"))
+		w.WriteChunkedBodyDone()
+		tr := headers.NewHeaders()
+		tr.Set("X-Sum", "2")
+		w.WriteTrailers(tr)
+	}, Config{})
+
+	// Test: chunked framing turns into DATA frames, and trailers into a
+	// last HEADERS frame
+	c.get(1, "/")
+	resp := c.response(1)
+	assert.Equal(t, "one two", resp.body)
+	assert.Equal(t, "", resp.get("transfer-encoding"))
+	assert.Equal(t, fields("x-sum", "2"), resp.trailers)
+
+	// Test: a HEAD gets the headers alone
+	c.headers(3, true, ":method", "HEAD", ":scheme", "http", ":path", "/", ":authority", "localhost")
+	resp = c.response(3)
+	assert.Equal(t, "200", resp.get(":status"))
+	assert.Equal(t, "", resp.body)
+	assert.Nil(t, resp.trailers)
+}
+
+func TestServeConnConcurrentStreams(t *testing.T) {
+	release := make(chan struct{})
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.Target.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte(req.Target.Path))
+	}, Config{MaxConcurrentStreams: 2})
+
+	// Test: a stream stuck in its handler doesn't hold up the next one
+	c.get(1, "/slow")
+	c.get(3, "/fast")
+	assert.Equal(t, "/fast", c.response(3).body)
+
+	// Test: past MaxConcurrentStreams streams are refused
+	c.get(5, "/slow")
+	c.get(7, "/slow")
+	c.expectReset(7, ErrCodeRefusedStream)
+	close(release)
+	resps := c.responses(1, 5)
+	assert.Equal(t, "/slow", resps[1].body)
+	assert.Equal(t, "/slow", resps[5].body)
+}
+
+func TestServeConnFlowControl(t *testing.T) {
+	body := strings.Repeat("x", 25)
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.Write([]byte(body))
+	}, Config{}, Setting{SettingInitialWindowSize, 10})
+
+	// Test: the response stops at the stream window
+	c.get(1, "/")
+	f := c.next()
+	require.Equal(t, FrameHeaders, f.Type)
+	f = c.next()
+	require.Equal(t, FrameData, f.Type)
+	assert.Len(t, f.Payload, 10)
+	assert.False(t, f.Has(FlagEndStream))
+
+	// Test: and carries on as the window opens
+	c.write(windowUpdateFrame(1, 100))
+	f = c.next()
+	require.Equal(t, FrameData, f.Type)
+	assert.Len(t, f.Payload, 15)
+	assert.True(t, f.Has(FlagEndStream))
+}
+
+func TestServeConnRequestWindow(t *testing.T) {
+	read, never := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { close(never) })
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		if req.Target.Path != "/read" {
+			<-never
+		}
+		<-read
+		io.ReadAll(req.BodyReader)
+	}, Config{})
+
+	// Test: the connection window comes back right away, the stream's
+	// once the handler has read the body
+	c.headers(1, false, ":method", "POST", ":scheme", "http", ":path", "/read")
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: []byte("12345")})
+	for {
+		f := c.nextAny()
+		if f.Type == FrameWindowUpdate {
+			assert.Equal(t, uint32(0), f.StreamID)
+			assert.Equal(t, uint32(5), binary.BigEndian.Uint32(f.Payload))
+			break
+		}
+	}
+	close(read)
+	f := c.nextAny()
+	require.Equal(t, FrameWindowUpdate, f.Type)
+	assert.Equal(t, uint32(1), f.StreamID)
+	assert.Equal(t, uint32(5), binary.BigEndian.Uint32(f.Payload))
+
+	// Test: DATA past the window of a stream nobody reads resets it
+	c.headers(3, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	for i := 0; i < 4; i++ {
+		c.write(Frame{Type: FrameData, StreamID: 3, Payload: make([]byte, defaultMaxFrameSize)})
+	}
+	c.expectReset(3, ErrCodeFlowControl)
+}
+
+func TestServeConnPing(t *testing.T) {
+	c := newTestClient(t, echo, Config{})
+
+	// Test: a PING is echoed back with an ack
+	c.write(Frame{Type: FramePing, Payload: []byte("12345678")})
+	f := c.next()
+	require.Equal(t, FramePing, f.Type)
+	assert.True(t, f.Has(FlagAck))
+	assert.Equal(t, "12345678", string(f.Payload))
+}
+
+func TestServeConnContinuation(t *testing.T) {
+	c := newTestClient(t, echo, Config{})
+
+	// Test: a header block split over CONTINUATION frames
+	block := c.enc.Encode(fields(":method", "GET", ":scheme", "http", ":path", "/split", ":authority", "a"))
+	c.write(Frame{Type: FrameHeaders, Flags: FlagEndStream, StreamID: 1, Payload: block[:3]})
+	c.write(Frame{Type: FrameContinuation, StreamID: 1, Payload: block[3:6]})
+	c.write(Frame{Type: FrameContinuation, Flags: FlagEndHeaders, StreamID: 1, Payload: block[6:]})
+	assert.Equal(t, "GET /split 2.0 a", c.response(1).get("x-request"))
+
+	// Test: anything but a CONTINUATION in the middle of a header block
+	c.write(Frame{Type: FrameHeaders, StreamID: 3, Payload: block[:3]})
+	c.write(Frame{Type: FramePing, Payload: []byte("12345678")})
+	c.expectGoAway(ErrCodeProtocol)
+}
+
+func TestServeConnMalformedRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+	}{
+		{"uppercase name", []string{":method", "GET", ":scheme", "http", ":path", "/", "X-Up", "1"}},
+		{"no path", []string{":method", "GET", ":scheme", "http"}},
+		{"pseudo after regular", []string{":method", "GET", "a", "b", ":scheme", "http", ":path", "/"}},
+		{"unknown pseudo", []string{":method", "GET", ":scheme", "http", ":path", "/", ":protocol", "x"}},
+		{"connection-specific", []string{":method", "GET", ":scheme", "http", ":path", "/", "connection", "close"}},
+		{"te other than trailers", []string{":method", "GET", ":scheme", "http", ":path", "/", "te", "gzip"}},
+		{"bad method", []string{":method", "get", ":scheme", "http", ":path", "/"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, echo, Config{})
+			// Test: a malformed request resets only its stream
+			c.headers(1, true, tc.pairs...)
+			c.expectReset(1, ErrCodeProtocol)
+			c.get(3, "/")
+			assert.Equal(t, "200", c.response(3).get(":status"))
+		})
+	}
+}
+
+func TestServeConnHeaderLimits(t *testing.T) {
+	c := newTestClient(t, echo, Config{Limits: request.Limits{MaxHeaderCount: 1}})
+
+	// Test: too many fields get a 431
+	c.headers(1, true, ":method", "GET", ":scheme", "http", ":path", "/", "a", "1", "b", "2")
+	assert.Equal(t, "431", c.response(1).get(":status"))
+}
+
+func TestServeConnErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame Frame
+		code  ErrCode
+	}{
+		{"DATA on an idle stream", Frame{Type: FrameData, StreamID: 1, Payload: []byte("x")}, ErrCodeProtocol},
+		{"HEADERS on stream 0", Frame{Type: FrameHeaders, Flags: FlagEndHeaders}, ErrCodeProtocol},
+		{"even stream", Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 2}, ErrCodeProtocol},
+		{"PUSH_PROMISE", Frame{Type: FramePushPromise, StreamID: 1, Payload: make([]byte, 4)}, ErrCodeProtocol},
+		{"short PING", Frame{Type: FramePing, Payload: []byte("1")}, ErrCodeFrameSize},
+		{"window update of 0", windowUpdateFrame(0, 0), ErrCodeProtocol},
+		{"window over 2^31-1", windowUpdateFrame(0, maxWindowSize), ErrCodeFlowControl},
+		{"bad header block", Frame{Type: FrameHeaders, Flags: FlagEndHeaders, StreamID: 1, Payload: []byte{0xff}}, ErrCodeCompression},
+		{"frame too big", Frame{Type: FrameData, StreamID: 1, Payload: make([]byte, defaultMaxFrameSize+1)}, ErrCodeFrameSize},
+		{"ENABLE_PUSH of 2", settingsFrame(Setting{SettingEnablePush, 2}), ErrCodeProtocol},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestClient(t, echo, Config{})
+			// Test: a connection error ends the connection with a GOAWAY,
+			// the server may stop reading halfway through the frame
+			go c.conn.Write(appendFrame(nil, tc.frame))
+			c.expectGoAway(tc.code)
+			select {
+			case err := <-c.served:
+				var ce *ConnectionError
+				require.ErrorAs(t, err, &ce)
+				assert.Equal(t, tc.code, ce.Code)
+			case <-time.After(2 * time.Second):
+				t.Fatal("ServeConn didn't return")
+			}
+		})
+	}
+}
+
+func TestServeConnPreface(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- ServeConn(server, server, echo, Config{}) }()
+
+	// Test: anything but the preface ends the connection
+	go io.Copy(io.Discard, client)
+	client.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	select {
+	case err := <-served:
+		assert.ErrorContains(t, err, "invalid client preface")
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn didn't return")
+	}
+}
+
+func TestServeConnIdleTimeout(t *testing.T) {
+	var states []bool
+	c := newTestClient(t, echo, Config{IdleTimeout: 50 * time.Millisecond, ConnState: func(idle bool) { states = append(states, idle) }})
+
+	// Test: ConnState follows the streams, and the connection goes away
+	// once it's idle for IdleTimeout
+	c.get(1, "/")
+	c.response(1)
+	c.expectGoAway(ErrCodeNo)
+	select {
+	case err := <-c.served:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn didn't return")
+	}
+	assert.Equal(t, []bool{false, true}, states)
+}
+
+func TestServeConnResetStream(t *testing.T) {
+	// answers without reading the body
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("early"))
+	}, Config{})
+
+	// Test: once the response is done the rest of the body is refused
+	c.headers(1, false, ":method", "POST", ":scheme", "http", ":path", "/")
+	assert.Equal(t, "early", c.response(1).body)
+	c.expectReset(1, ErrCodeNo)
+
+	// Test: what the client sent before it knew is ignored, trailers
+	// included, and their header block still goes through the decoder
+	c.write(Frame{Type: FrameData, StreamID: 1, Payload: []byte("late")})
+	c.headers(1, true, "x-sum", "1")
+	c.headers(3, true, ":method", "GET", ":scheme", "http", ":path", "/", "x-sum", "1")
+	assert.Equal(t, "early", c.response(3).body)
+}
+
+func TestServeConnRapidReset(t *testing.T) {
+	var running, most atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	handler := func(w *response.Writer, req *request.Request) {
+		n := running.Add(1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		<-release
+		running.Add(-1)
+	}
+	c := newTestClient(t, handler, Config{MaxConcurrentStreams: 2})
+
+	// Test: a stream the client resets still counts until its handler
+	// returns, so no more than MaxConcurrentStreams handlers run at once
+	for id := uint32(1); id < 40; id += 2 {
+		c.get(id, "/")
+		c.write(rstStreamFrame(id, ErrCodeCancel))
+	}
+	for id := uint32(5); id < 40; id += 2 {
+		c.expectReset(id, ErrCodeRefusedStream)
+	}
+	assert.Equal(t, int32(2), most.Load())
+
+	// Test: a client that keeps at it is sent away
+	c = newTestClient(t, handler, Config{MaxConcurrentStreams: 2})
+	go func() {
+		enc := NewEncoder()
+		for id := uint32(1); id < 2*(maxClientResets+10); id += 2 {
+			block := enc.Encode(fields(":method", "GET", ":scheme", "http", ":path", "/"))
+			c.conn.Write(appendFrame(nil, Frame{Type: FrameHeaders, Flags: FlagEndHeaders | FlagEndStream, StreamID: id, Payload: block}))
+			c.conn.Write(appendFrame(nil, rstStreamFrame(id, ErrCodeCancel)))
+		}
+	}()
+	for {
+		f := c.next()
+		if f.Type == FrameRSTStream {
+			continue
+		}
+		require.Equal(t, FrameGoAway, f.Type)
+		assert.Equal(t, ErrCodeEnhanceYourCalm, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+		break
+	}
+}
+
+func TestServeConnShutdown(t *testing.T) {
+	started, release, shutdown := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	c := newTestClient(t, func(w *response.Writer, req *request.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}, Config{Shutdown: shutdown})
+	c.get(1, "/")
+	<-started
+
+	// Test: the GOAWAY names the last stream that will be answered
+	close(shutdown)
+	f := c.next()
+	require.Equal(t, FrameGoAway, f.Type)
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(f.Payload[:4]))
+	assert.Equal(t, ErrCodeNo, ErrCode(binary.BigEndian.Uint32(f.Payload[4:])))
+
+	// Test: streams opened after it are refused
+	c.get(3, "/")
+	c.expectReset(3, ErrCodeRefusedStream)
+
+	// Test: the open one still finishes, then the connection ends
+	close(release)
+	assert.Equal(t, "done", c.response(1).body)
+	select {
+	case err := <-c.served:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn didn't return")
+	}
+
+	// Test: without open streams it ends right away
+	shutdown = make(chan struct{})
+	c = newTestClient(t, echo, Config{Shutdown: shutdown})
+	close(shutdown)
+	c.expectGoAway(ErrCodeNo)
+	select {
+	case err := <-c.served:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeConn didn't return")
+	}
+}
+
+func upgradeRequest(t *testing.T, settings string) *request.Request {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader("POST /up HTTP/1.1\r\nHost: localhost\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: " + settings + "\r\n" +
+		"Content-Length: 4\r\n\r\nbody"))
+	require.NoError(t, err)
+	return req
+}
+
+func TestIsUpgrade(t *testing.T) {
+	// Test: an h2c upgrade with its settings
+	settings := base64.RawURLEncoding.EncodeToString(settingsFrame(Setting{SettingInitialWindowSize, 100}).Payload)
+	assert.True(t, IsUpgrade(upgradeRequest(t, settings)))
+	assert.True(t, IsUpgrade(upgradeRequest(t, "")))
+
+	// Test: settings that don't decode
+	assert.False(t, IsUpgrade(upgradeRequest(t, "!!")))
+	assert.False(t, IsUpgrade(upgradeRequest(t, "AAAA")))
+
+	// Test: a WebSocket upgrade isn't one
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, IsUpgrade(req))
+}
+
+func TestServeUpgrade(t *testing.T) {
+	client, server := net.Pipe()
+	c := startTestClient(t, client)
+	settings := base64.RawURLEncoding.EncodeToString(settingsFrame(Setting{SettingMaxFrameSize, 1 << 20}).Payload)
+	go func() { c.served <- ServeUpgrade(server, server, echo, Config{}, upgradeRequest(t, settings)) }()
+
+	// Test: a 101, then the response to the upgraded request on stream 1
+	br := bufio.NewReader(client)
+	var head string
+	for !strings.HasSuffix(head, "\r\n\r\n") {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		head += line
+	}
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n", head)
+	c.readFrames(br)
+	f := c.nextAny()
+	require.Equal(t, FrameSettings, f.Type)
+	resp := c.response(1)
+	assert.Equal(t, "POST /up 1.1 localhost", resp.get("x-request"))
+	assert.Equal(t, "body", resp.body)
+
+	// Test: the client carries on with HTTP/2
+	c.writeRaw([]byte(ClientPreface))
+	c.write(settingsFrame())
+	c.get(3, "/next")
+	assert.Equal(t, "GET /next 2.0 localhost", c.response(3).get("x-request"))
+}
@@ -0,0 +1,407 @@
+package http2
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stream is a request and its response. The response side is the
+// response.Stream its handler's Writer goes through.
+type stream struct {
+	sc   *serverConn
+	id   uint32
+	body *pipe
+	req  *request.Request // nil when the handler doesn't get the body
+
+	// only touched by the read loop
+	received       int64
+	declaredLength int64 // content-length, -1 if there's none
+
+	// guarded by sc.mu
+	recvWindow int64
+	sendWindow int64
+	recvClosed bool // END_STREAM came in
+	sendClosed bool // the response is done
+	handled    bool // the handler returned
+	reset      bool
+
+	// only touched by the handler
+	status response.StatusCode
+	header *headers.Headers // the final headers, held until there's data or the end
+	buf    []byte
+	done   bool
+}
+
+// Body is sent in frames of up to this much, if the peer takes them.
+const dataChunkSize = 16 << 10
+
+// Fields that only mean something to an HTTP/1 connection, RFC 9113 8.2.2.
+var connectionFields = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func (st *stream) WriteHeaders(statusCode response.StatusCode, h *headers.Headers) error {
+	if statusCode < 200 {
+		return st.writeHeaders(statusCode, h, false)
+	}
+	st.status, st.header = statusCode, h
+	return nil
+}
+
+func (st *stream) WriteData(p []byte) error {
+	st.buf = append(st.buf, p...)
+	if len(st.buf) >= dataChunkSize {
+		return st.flush(false)
+	}
+	return nil
+}
+
+func (st *stream) WriteTrailers(h *headers.Headers) error {
+	if err := st.flush(false); err != nil {
+		return err
+	}
+	st.done = true
+	return st.writeHeaders(0, h, true)
+}
+
+func (st *stream) Flush() error {
+	return st.flush(false)
+}
+
+func (st *stream) Close() error {
+	if st.done {
+		return nil
+	}
+	st.done = true
+	return st.flush(true)
+}
+
+func (st *stream) Abort() error {
+	if st.done {
+		return nil
+	}
+	st.done = true
+	st.sc.mu.Lock()
+	reset := st.reset
+	st.sc.mu.Unlock()
+	if !reset {
+		st.sc.resetStream(st.id, ErrCodeInternal)
+	}
+	return nil
+}
+
+// Sends the held headers and whatever body is buffered, ending the stream
+// with the last frame if end is set.
+func (st *stream) flush(end bool) error {
+	if st.header != nil {
+		h := st.header
+		st.header = nil
+		if err := st.writeHeaders(st.status, h, end && len(st.buf) == 0); err != nil {
+			return err
+		}
+		if len(st.buf) == 0 {
+			return nil
+		}
+	}
+	for len(st.buf) > 0 || end {
+		n, err := st.reserve(min(len(st.buf), dataChunkSize))
+		if err != nil {
+			return err
+		}
+		f := Frame{Type: FrameData, StreamID: st.id, Payload: st.buf[:n]}
+		last := n == len(st.buf)
+		if end && last {
+			f.Flags = FlagEndStream
+			st.endSend()
+		}
+		if err := st.sc.writeFrame(f); err != nil {
+			return err
+		}
+		st.buf = st.buf[n:]
+		if last {
+			break
+		}
+	}
+	st.buf = nil
+	return nil
+}
+
+// endSend is called right before the last frame of the response goes out.
+// Once the client has it the stream may be closed as far as it can tell,
+// and no longer count against MaxConcurrentStreams.
+func (st *stream) endSend() {
+	sc := st.sc
+	sc.mu.Lock()
+	st.sendClosed = true
+	done := st.recvClosed
+	sc.mu.Unlock()
+	if done {
+		sc.removeStream(st)
+	}
+}
+
+// reserve waits for the flow control windows to take some of n bytes and
+// returns how many it got. An empty frame needs no window.
+func (st *stream) reserve(n int) (int, error) {
+	sc := st.sc
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if sc.closed {
+			return 0, errConnClosed
+		}
+		if st.reset {
+			return 0, errStreamClosed
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		if sc.sendWindow > 0 && st.sendWindow > 0 {
+			break
+		}
+		sc.cond.Wait()
+	}
+	n = int(min(int64(n), sc.sendWindow, st.sendWindow, int64(sc.peerMaxFrameSize)))
+	sc.sendWindow -= int64(n)
+	st.sendWindow -= int64(n)
+	return n, nil
+}
+
+// writeHeaders sends a header block, trailers when statusCode is 0, in a
+// HEADERS frame and as many CONTINUATION frames as it takes.
+func (st *stream) writeHeaders(statusCode response.StatusCode, h *headers.Headers, endStream bool) error {
+	var fields []HeaderField
+	if statusCode != 0 {
+		fields = append(fields, HeaderField{Name: ":status", Value: strconv.Itoa(int(statusCode))})
+	}
+	for _, f := range h.Fields() {
+		name := strings.ToLower(f.Name)
+		if connectionFields[name] {
+			continue
+		}
+		fields = append(fields, HeaderField{Name: name, Value: f.Value})
+	}
+
+	sc := st.sc
+	sc.mu.Lock()
+	maxFrameSize := int(sc.peerMaxFrameSize)
+	reset, closed := st.reset, sc.closed
+	sc.mu.Unlock()
+	if closed {
+		return errConnClosed
+	}
+	if reset {
+		return errStreamClosed
+	}
+
+	f := Frame{Type: FrameHeaders, StreamID: st.id}
+	if endStream {
+		f.Flags = FlagEndStream
+		st.endSend()
+	}
+	sc.wmu.Lock()
+	defer sc.wmu.Unlock()
+	block := sc.enc.Encode(fields)
+	for {
+		n := min(len(block), maxFrameSize)
+		f.Payload = block[:n]
+		block = block[n:]
+		if len(block) == 0 {
+			f.Flags |= FlagEndHeaders
+		}
+		if err := WriteFrame(sc.conn, f); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		f = Frame{Type: FrameContinuation, StreamID: st.id}
+	}
+}
+
+// newRequest turns a request's header list into a request.Request, RFC
+// 9113 8.3.1. A malformed one is a stream error, one over the limits
+// request.ErrHeaderTooLarge or request.ErrTooManyHeaders. It also returns
+// the content-length, -1 if there's none.
+func (sc *serverConn) newRequest(id uint32, fields []HeaderField) (*request.Request, int64, error) {
+	size, count := 0, 0
+	for _, f := range fields {
+		size += int(f.size())
+		if !strings.HasPrefix(f.Name, ":") {
+			count++
+		}
+	}
+	if size > sc.limits.MaxHeaderBytes {
+		return nil, 0, request.ErrHeaderTooLarge
+	}
+	if count > sc.limits.MaxHeaderCount {
+		return nil, 0, request.ErrTooManyHeaders
+	}
+
+	pseudo := map[string]string{}
+	h := headers.NewHeaders()
+	var cookies, lengths []string
+	for _, f := range fields {
+		if name, ok := strings.CutPrefix(f.Name, ":"); ok {
+			if h.Len() > 0 || cookies != nil {
+				return nil, 0, streamError(id, ErrCodeProtocol, "pseudo-header %s after a regular one", f.Name)
+			}
+			switch name {
+			case "method", "scheme", "path", "authority":
+			default:
+				return nil, 0, streamError(id, ErrCodeProtocol, "unknown pseudo-header %s", f.Name)
+			}
+			if _, dup := pseudo[name]; dup {
+				return nil, 0, streamError(id, ErrCodeProtocol, "pseudo-header %s twice", f.Name)
+			}
+			pseudo[name] = f.Value
+			continue
+		}
+		if err := validateField(id, f); err != nil {
+			return nil, 0, err
+		}
+		switch f.Name {
+		case "cookie":
+			// split up for compression, RFC 9113 8.2.3
+			cookies = append(cookies, f.Value)
+			continue
+		case "content-length":
+			lengths = append(lengths, f.Value)
+		}
+		h.Add(f.Name, f.Value)
+	}
+	if cookies != nil {
+		h.Add("cookie", strings.Join(cookies, "; "))
+	}
+
+	method, authority := pseudo["method"], pseudo["authority"]
+	target := pseudo["path"]
+	if method == "CONNECT" {
+		if _, ok := pseudo["scheme"]; ok || target != "" || authority == "" {
+			return nil, 0, streamError(id, ErrCodeProtocol, "malformed CONNECT")
+		}
+		target = authority
+	} else if method == "" || pseudo["scheme"] == "" || target == "" {
+		return nil, 0, streamError(id, ErrCodeProtocol, "missing pseudo-header")
+	}
+	if _, ok := h.Get("Host"); !ok && authority != "" {
+		h.Add("host", authority)
+	}
+
+	declaredLength := int64(-1)
+	if len(lengths) > 0 {
+		for _, l := range lengths {
+			n, err := strconv.ParseInt(l, 10, 64)
+			if err != nil || n < 0 || declaredLength >= 0 && n != declaredLength {
+				return nil, 0, streamError(id, ErrCodeProtocol, "invalid content-length %q", l)
+			}
+			declaredLength = n
+		}
+	}
+
+	req, err := request.NewRequest(method, target, "2.0", h, nil)
+	if err != nil {
+		return nil, 0, streamError(id, ErrCodeProtocol, "%v", err)
+	}
+	return req, declaredLength, nil
+}
+
+// A field of a request's header or trailer list, RFC 9113 8.2.
+func validateField(id uint32, f HeaderField) error {
+	if strings.ToLower(f.Name) != f.Name {
+		return streamError(id, ErrCodeProtocol, "uppercase field name %q", f.Name)
+	}
+	if err := headers.ValidateField(f.Name, f.Value); err != nil {
+		return streamError(id, ErrCodeProtocol, "%v", err)
+	}
+	if connectionFields[f.Name] {
+		return streamError(id, ErrCodeProtocol, "connection-specific field %s", f.Name)
+	}
+	if f.Name == "te" && f.Value != "trailers" {
+		return streamError(id, ErrCodeProtocol, "te: %s", f.Value)
+	}
+	return nil
+}
+
+// pipe is a request body, written by the read loop as DATA comes in and
+// read by the handler.
+type pipe struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	err    error // returned once buf is drained, io.EOF at the end
+	closed bool  // the handler is done with it
+	onRead func(n int)
+}
+
+// onRead is told how much of the body the handler took off the pipe.
+func newPipe(onRead func(n int)) *pipe {
+	p := &pipe{onRead: onRead}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	for p.buf.Len() == 0 && p.err == nil && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		p.mu.Unlock()
+		return 0, request.ErrBodyReadAfterClose
+	}
+	if p.buf.Len() == 0 {
+		err := p.err
+		p.mu.Unlock()
+		return 0, err
+	}
+	n, _ := p.buf.Read(b)
+	p.mu.Unlock()
+	p.onRead(n)
+	return n, nil
+}
+
+// Close drops whatever wasn't read, its window is given back.
+func (p *pipe) Close() error {
+	p.mu.Lock()
+	n := p.buf.Len()
+	p.buf.Reset()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.onRead(n)
+	return nil
+}
+
+// write reports whether the data went in, it doesn't once the body has
+// ended or the handler closed it.
+func (p *pipe) write(b []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.err != nil {
+		return false
+	}
+	p.buf.Write(b)
+	p.cond.Broadcast()
+	return true
+}
+
+// closeWithError ends the body with err once what's buffered is read. Only
+// the first error sticks.
+func (p *pipe) closeWithError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
@@ -0,0 +1,297 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrBodyReadAfterClose = errors.New("request body read after close")
+
+// body is the Request.BodyReader. It pulls bytes off the connection only
+// when the handler asks for them, framed by Content-Length or chunked
+// encoding, so a large upload never has to sit in memory.
+type body struct {
+	request *Request
+	reader  *Reader
+	closed  bool
+	err     error
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	return b.read(p)
+}
+
+// Close only stops the handler from reading more. Whatever is left of the
+// body is skipped by the Reader before it parses the next request.
+func (b *body) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *body) read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if b.request.State == requestState_done {
+			return 0, io.EOF
+		}
+		bytesConsumed, bytesWritten, err := b.request.parseBody(b.reader.buffered(), p)
+		b.reader.consume(bytesConsumed)
+		if err != nil {
+			b.err = err
+			return bytesWritten, err
+		}
+		if bytesWritten > 0 {
+			return bytesWritten, nil
+		}
+		if bytesConsumed > 0 {
+			continue
+		}
+		if err := b.reader.fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w: body ended after %d bytes: %w", ErrIncompleteRequest, b.request.bodyLengthRead, io.ErrUnexpectedEOF)
+			}
+			b.err = err
+			return 0, err
+		}
+	}
+}
+
+// Reads and throws away the rest of the body.
+func (b *body) discardAll() error {
+	buf := make([]byte, 512)
+	for {
+		_, err := b.read(buf)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Reads and throws away up to max bytes of what's left of the body.
+// Returns false if the body was longer than that or couldn't be read.
+func (b *body) discard(max int) bool {
+	buf := make([]byte, 512)
+	for discarded := 0; discarded <= max; {
+		n, err := b.read(buf)
+		discarded += n
+		if errors.Is(err, io.EOF) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// ReadBody reads whatever is left of BodyReader into Body and returns it.
+// Bodies are streamed by default, handlers that want the whole thing in
+// memory opt in by calling this.
+func (r *Request) ReadBody() ([]byte, error) {
+	data, err := io.ReadAll(r.BodyReader)
+	r.Body = append(r.Body, data...)
+	return r.Body, err
+}
+
+// parseContentLength reads the Content-Length field lines. Repeats are only
+// accepted when they all agree, RFC 9112 6.3 says to reject the rest.
+func parseContentLength(lengths []string) (int, error) {
+	value := ""
+	for _, line := range lengths {
+		for _, v := range strings.Split(line, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				return 0, fmt.Errorf("%w: empty value in %q", ErrInvalidContentLength, strings.Join(lengths, ", "))
+			}
+			if value != "" && v != value {
+				return 0, fmt.Errorf("%w: differing values %q", ErrInvalidContentLength, strings.Join(lengths, ", "))
+			}
+			value = v
+		}
+	}
+	// 1*DIGIT, Atoi alone would take "+5" or "-0"
+	for i := 0; i < len(value); i++ {
+		if !isDigit(value[i]) {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || value == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+	}
+	return n, nil
+}
+
+// Fields a recipient needs before the content, so they can't come in
+// trailers, RFC 9110 6.5.1: framing, routing, authentication, request
+// modifiers and the content's format.
+var forbiddenTrailers = map[string]bool{
+	"content-length":      true,
+	"transfer-encoding":   true,
+	"trailer":             true,
+	"host":                true,
+	"connection":          true,
+	"keep-alive":          true,
+	"proxy-connection":    true,
+	"upgrade":             true,
+	"te":                  true,
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"expect":              true,
+	"max-forwards":        true,
+	"cache-control":       true,
+	"pragma":              true,
+	"range":               true,
+	"if-match":            true,
+	"if-none-match":       true,
+	"if-modified-since":   true,
+	"if-unmodified-since": true,
+	"if-range":            true,
+	"content-type":        true,
+	"content-encoding":    true,
+	"content-range":       true,
+}
+
+// The forbidden trailers that would change how the message is framed or
+// where it goes if anyone took them from there. Those fail the request, the
+// rest are just dropped.
+var refusedTrailers = map[string]bool{
+	"content-length":    true,
+	"transfer-encoding": true,
+	"trailer":           true,
+	"host":              true,
+}
+
+// TrailerAllowed reports whether a field may be kept as a trailer.
+func TrailerAllowed(name string) bool {
+	return !forbiddenTrailers[strings.ToLower(name)]
+}
+
+// TrailerRefused reports whether a field in the trailers fails the whole
+// request, rather than being dropped like other fields that aren't allowed.
+func TrailerRefused(name string) bool {
+	return refusedTrailers[strings.ToLower(name)]
+}
+
+// Fails on framing and routing fields in the trailers, and drops the rest
+// of the fields that aren't allowed there.
+func checkTrailers(h *headers.Headers) error {
+	dropped := []string{}
+	for _, f := range h.Fields() {
+		if TrailerRefused(f.Name) {
+			return fmt.Errorf("%w: %s", ErrForbiddenTrailer, f.Name)
+		}
+		if !TrailerAllowed(f.Name) {
+			dropped = append(dropped, f.Name)
+		}
+	}
+	for _, name := range dropped {
+		h.Del(name)
+	}
+	return nil
+}
+
+// Works out how the body is framed once the headers are in.
+func (r *Request) startBody() error {
+	// A request that two servers could frame differently is how one gets
+	// smuggled past a proxy, so anything ambiguous is refused (RFC 9112 6).
+	encodings := r.Headers.Values("Transfer-Encoding")
+	lengths := r.Headers.Values("Content-Length")
+	if len(encodings) > 0 {
+		if len(lengths) > 0 {
+			return fmt.Errorf("%w: Transfer-Encoding and Content-Length", ErrConflictingFraming)
+		}
+		// RFC 9112 6.1: a 1.0 message has no business using it, its framing
+		// can't be trusted.
+		if r.RequestLine.HttpVersion == "1.0" {
+			return fmt.Errorf("%w: Transfer-Encoding in an HTTP/1.0 request", ErrInvalidTransferCoding)
+		}
+		if err := checkTransferCodings(encodings); err != nil {
+			return err
+		}
+		r.State = requestState_parsingChunkSize
+		return nil
+	}
+	if len(lengths) == 0 {
+		// no body, anything left belongs to the next request
+		r.State = requestState_done
+		return nil
+	}
+	content_length, err := parseContentLength(lengths)
+	if err != nil {
+		return err
+	}
+	// refused before reading any of it
+	if r.limits.MaxBodyBytes > 0 && int64(content_length) > r.limits.MaxBodyBytes {
+		return ErrBodyTooLarge
+	}
+	r.contentLength = content_length
+	r.State = requestState_parsingBody
+	if content_length == 0 {
+		r.State = requestState_done
+	}
+	return nil
+}
+
+// Copies body bytes out of data into p, handing the chunked framing in
+// between to parseSingle. Never takes more than the body, whatever follows
+// belongs to the next request.
+func (r *Request) parseBody(data, p []byte) (int, int, error) {
+	totalBytesParsed, totalBytesWritten := 0, 0
+	for r.State != requestState_done && totalBytesWritten < len(p) {
+		remaining := 0
+		switch {
+		case r.State == requestState_parsingBody:
+			remaining = r.contentLength - r.bodyLengthRead
+		case r.State == requestState_parsingChunkData && r.chunkRemaining > 0:
+			remaining = r.chunkRemaining
+		default:
+			state := r.State
+			n, err := r.parseSingle(data[totalBytesParsed:])
+			if err != nil {
+				return totalBytesParsed, totalBytesWritten, err
+			}
+			totalBytesParsed += n
+			if n == 0 && r.State == state {
+				return totalBytesParsed, totalBytesWritten, nil
+			}
+			continue
+		}
+
+		n := min(remaining, len(data)-totalBytesParsed, len(p)-totalBytesWritten)
+		if n == 0 {
+			break
+		}
+		// chunked bodies only find out as they go
+		if r.limits.MaxBodyBytes > 0 && int64(r.bodyLengthRead+n) > r.limits.MaxBodyBytes {
+			return totalBytesParsed, totalBytesWritten, ErrBodyTooLarge
+		}
+		copy(p[totalBytesWritten:], data[totalBytesParsed:totalBytesParsed+n])
+		totalBytesParsed += n
+		totalBytesWritten += n
+		r.bodyLengthRead += n
+		if r.State == requestState_parsingChunkData {
+			r.chunkRemaining -= n
+		} else if r.bodyLengthRead == r.contentLength {
+			r.State = requestState_done
+		}
+	}
+	return totalBytesParsed, totalBytesWritten, nil
+}
@@ -0,0 +1,78 @@
+package request
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Largest chunk we're willing to accept, keeps the size from overflowing an int.
+const maxChunkSize = 1<<31 - 1
+
+// Longest chunk-size line, extensions included.
+const maxChunkLineLength = 4096
+
+// chunk          = chunk-size [ chunk-ext ] CRLF chunk-data CRLF
+// chunk-ext      = *( BWS ";" BWS chunk-ext-name [ BWS "=" BWS chunk-ext-val ] )
+//
+// parseChunkSize reads the chunk-size line. Chunk extensions are checked for
+// shape and then ignored, nothing we serve gives them a meaning.
+// Returns 0 bytes consumed when the line isn't complete yet.
+func parseChunkSize(data []byte, strict bool) (int, int, error) {
+	lineBytes, n, err := headers.ReadLine(data, strict)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%w: %w", ErrMalformedChunk, err)
+	}
+	if n == 0 {
+		if len(data) > maxChunkLineLength {
+			return 0, 0, fmt.Errorf("%w: chunk-size line too long", ErrMalformedChunk)
+		}
+		return 0, 0, nil
+	}
+	line := string(lineBytes)
+	sizePart, extensions, _ := strings.Cut(line, ";")
+	sizePart = strings.TrimRight(sizePart, " \t")
+	if sizePart == "" {
+		return 0, 0, fmt.Errorf("%w: missing chunk size: %q", ErrMalformedChunk, line)
+	}
+	size, err := strconv.ParseUint(sizePart, 16, 64)
+	if err != nil || size > maxChunkSize {
+		return 0, 0, fmt.Errorf("%w: invalid chunk size: %q", ErrMalformedChunk, sizePart)
+	}
+	if extensions != "" {
+		for _, ext := range strings.Split(extensions, ";") {
+			name, _, _ := strings.Cut(ext, "=")
+			if strings.TrimSpace(name) == "" {
+				return 0, 0, fmt.Errorf("%w: invalid chunk extension: %q", ErrMalformedChunk, line)
+			}
+		}
+	}
+	return int(size), n, nil
+}
+
+// checkTransferCodings makes sure the Transfer-Encoding field lines come
+// down to just chunked. RFC 9112 6.3: chunked has to be the final coding,
+// once, otherwise there's no way to tell where a request body ends. Other
+// codings are fine by the RFC but we can't decode them.
+func checkTransferCodings(encodings []string) error {
+	var codings []string
+	for _, encoding := range encodings {
+		for _, coding := range strings.Split(encoding, ",") {
+			if coding = strings.TrimSpace(coding); coding != "" {
+				codings = append(codings, strings.ToLower(coding))
+			}
+		}
+	}
+	if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+		return fmt.Errorf("%w: chunked is not the final coding: %q", ErrInvalidTransferCoding, strings.Join(encodings, ", "))
+	}
+	if len(codings) > 1 {
+		if slices.Contains(codings[:len(codings)-1], "chunked") {
+			return fmt.Errorf("%w: chunked applied more than once", ErrInvalidTransferCoding)
+		}
+		return fmt.Errorf("%w: %q", ErrUnsupportedTransferCoding, codings[0])
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package request
+
+import "errors"
+
+// Errors the parser returns, wrapped with the details of what it choked on.
+// Check them with errors.Is, the server uses them to pick a status code.
+// The size errors live next to Limits.
+var (
+	ErrMalformedRequestLine  = errors.New("malformed request-line")
+	ErrInvalidMethod         = errors.New("invalid method")
+	ErrInvalidTarget         = errors.New("invalid request-target")
+	ErrUnsupportedVersion    = errors.New("unsupported HTTP version")
+	ErrMalformedHeader       = errors.New("malformed header field")
+	ErrInvalidContentLength  = errors.New("invalid Content-Length")
+	ErrInvalidTransferCoding = errors.New("invalid Transfer-Encoding")
+	ErrConflictingFraming    = errors.New("conflicting message framing")
+	ErrMalformedChunk        = errors.New("malformed chunked body")
+	// ErrForbiddenTrailer is a trailer field that only means something in
+	// the header section, like Content-Length or Host.
+	ErrForbiddenTrailer = errors.New("field not allowed in trailers")
+	// ErrUnsupportedTransferCoding is a well formed coding the server
+	// doesn't implement, as opposed to a nonsensical list of codings.
+	ErrUnsupportedTransferCoding = errors.New("unsupported transfer coding")
+	ErrIncompleteRequest         = errors.New("incomplete request")
+	// ErrUnsupportedExpectation is an Expect other than 100-continue.
+	ErrUnsupportedExpectation = errors.New("unsupported expectation")
+)
@@ -0,0 +1,121 @@
+package request
+
+import (
+	"errors"
+	"httpfromtcp/internal/headers"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want error
+	}{
+		{"GET /\r\n\r\n", ErrMalformedRequestLine},
+		{"GET / HTTP/one\r\n\r\n", ErrMalformedRequestLine},
+		{"get / HTTP/1.1\r\n\r\n", ErrInvalidMethod},
+		{"GET foo HTTP/1.1\r\n\r\n", ErrInvalidTarget},
+		{"GET / HTTP/2.0\r\n\r\n", ErrUnsupportedVersion},
+		{"GET / HTTP/1.1\r\nHost localhost\r\n\r\n", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", ErrInvalidContentLength},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", ErrInvalidTransferCoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nxyz\r\n", ErrMalformedChunk},
+		{"POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc", ErrIncompleteRequest},
+		{"GET / HTTP/1.1\r\nHost: loc", ErrIncompleteRequest},
+		// framing that two parsers could read differently
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n0\r\n\r\n", ErrConflictingFraming},
+		{"POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabcd", ErrInvalidContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: 3, 4\r\n\r\nabcd", ErrInvalidContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: +3\r\n\r\nabc", ErrInvalidContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length:\r\n\r\n", ErrInvalidContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: ,5\r\n\r\nabcde", ErrInvalidContentLength},
+		{"POST / HTTP/1.1\r\nContent-Length: 5,,5\r\n\r\nabcde", ErrInvalidContentLength},
+		// white space before the first field isn't a continuation of anything
+		{"POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrMalformedHeader},
+		{"POST / HTTP/1.1\r\n Content-Length: 5\r\n\r\nabcde", ErrMalformedHeader},
+		// fields that can't come after the body
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nContent-Length: 5\r\n\r\n", ErrForbiddenTrailer},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX-A: a\r\nhost: other\r\n\r\n", ErrForbiddenTrailer},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", ErrUnsupportedTransferCoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", ErrUnsupportedTransferCoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", ErrInvalidTransferCoding},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: identity\r\n\r\n", ErrInvalidTransferCoding},
+	} {
+		_, err := RequestFromReader(strings.NewReader(tc.data))
+		require.Error(t, err, tc.data)
+		assert.True(t, errors.Is(err, tc.want), "%q: got %v", tc.data, err)
+	}
+
+	// Test: header errors keep the headers package's cause
+	_, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nH@st: localhost\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldName)
+
+	// Test: so do invalid values
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-A: a\x00b\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+
+	// Test: a forbidden trailer is a malformed header like any other
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nTrailer: X\r\n\r\n"))
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+	assert.ErrorIs(t, err, ErrForbiddenTrailer)
+
+	// Test: white space before the first field is refused in strict mode too
+	_, err = NewReaderWithLimits(strings.NewReader("POST / HTTP/1.1\r\n Content-Length: 5\r\n\r\nabcde"), Limits{Strict: true}).ReadRequest()
+	assert.ErrorIs(t, err, ErrMalformedHeader)
+	assert.ErrorIs(t, err, headers.ErrMalformedFieldLine)
+
+	// Test: a request cut short is an unexpected EOF
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestFramingAccepted(t *testing.T) {
+	// Test: repeated Content-Length values that agree
+	for _, data := range []string{
+		"POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nContent-Length: 3, 3\r\n\r\nabc",
+		"POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+	} {
+		r, err := RequestFromReader(strings.NewReader(data))
+		require.NoError(t, err, data)
+		assert.Equal(t, "abc", string(r.Body))
+	}
+}
+
+func TestStrictLineEndings(t *testing.T) {
+	lenient := []struct {
+		data string
+		body string
+	}{
+		{"GET / HTTP/1.1\nHost: a\n\n", ""},
+		{"\nGET / HTTP/1.1\r\nHost: a\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nX-A: a\r\n b\r\n\r\n", ""},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\nabc\n0\n\n", "abc"},
+	}
+	for _, tc := range lenient {
+		// Test: tolerated by default
+		r, err := RequestFromReader(strings.NewReader(tc.data))
+		require.NoError(t, err, tc.data)
+		assert.Equal(t, tc.body, string(r.Body))
+
+		// Test: refused in strict mode
+		r, err = NewReaderWithLimits(strings.NewReader(tc.data), Limits{Strict: true}).ReadRequest()
+		if err == nil {
+			_, err = r.ReadBody()
+		}
+		require.Error(t, err, tc.data)
+		assert.True(t, errors.Is(err, headers.ErrBareLF) || errors.Is(err, headers.ErrObsFold), "%q: %v", tc.data, err)
+	}
+
+	// Test: obs-fold is unfolded into the field before it
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nX-A: a\r\n b\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a b"}, r.Headers.Values("X-A"))
+}
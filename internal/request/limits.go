@@ -0,0 +1,74 @@
+package request
+
+import "errors"
+
+// Errors for requests that go over Limits. The server answers them with
+// 414, 431 and 413.
+var (
+	ErrRequestLineTooLong = errors.New("request-line too long")
+	ErrHeaderTooLarge     = errors.New("header section too large")
+	ErrTooManyHeaders     = errors.New("too many header fields")
+	ErrBodyTooLarge       = errors.New("request body too large")
+)
+
+// Limits caps how much of a request the parser will take in, so a client
+// can't make it buffer without bound, and how forgiving it is.
+type Limits struct {
+	// MaxRequestLineBytes caps the request-line, CRLF not included.
+	// Zero means DefaultLimits.MaxRequestLineBytes.
+	MaxRequestLineBytes int
+	// MaxHeaderBytes caps the header section, and separately the trailer
+	// section. Zero means DefaultLimits.MaxHeaderBytes.
+	MaxHeaderBytes int
+	// MaxHeaderCount caps the number of header fields, and separately the
+	// trailer fields. Zero means DefaultLimits.MaxHeaderCount.
+	MaxHeaderCount int
+	// MaxBodyBytes caps the body. Zero means no limit.
+	MaxBodyBytes int64
+	// Strict refuses bare LF line endings and obs-fold, which the parser
+	// otherwise tolerates as RFC 9112 allows. Turn it on behind a proxy
+	// that may not read them the same way.
+	Strict bool
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes: 8 << 10,
+	MaxHeaderBytes:      64 << 10,
+	MaxHeaderCount:      100,
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineBytes <= 0 {
+		l.MaxRequestLineBytes = DefaultLimits.MaxRequestLineBytes
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	return l
+}
+
+// Keeps count of a header or trailer section as it's parsed. data is what
+// was handed to the field parser, bytesConsumed what it took from it.
+func (r *Request) checkFieldLimits(data []byte, bytesConsumed int, done bool) error {
+	if bytesConsumed == 0 {
+		// no full line yet, but the partial one already counts
+		if r.fieldBytes+len(data) > r.limits.MaxHeaderBytes {
+			return ErrHeaderTooLarge
+		}
+		return nil
+	}
+	r.fieldBytes += bytesConsumed
+	if r.fieldBytes > r.limits.MaxHeaderBytes {
+		return ErrHeaderTooLarge
+	}
+	if !done {
+		r.fieldCount++
+		if r.fieldCount > r.limits.MaxHeaderCount {
+			return ErrTooManyHeaders
+		}
+	}
+	return nil
+}
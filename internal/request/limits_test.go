@@ -0,0 +1,93 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readWithLimits(data string, limits Limits) (*Request, error) {
+	reader := NewReaderWithLimits(&chunkReader{data: data, numBytesPerRead: 16}, limits)
+	r, err := reader.ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.ReadBody()
+	return r, err
+}
+
+func TestLimits_RequestLine(t *testing.T) {
+	limits := Limits{MaxRequestLineBytes: 32}
+
+	// Test: Fits
+	_, err := readWithLimits("GET /short HTTP/1.1\r\n\r\n", limits)
+	require.NoError(t, err)
+
+	// Test: Too long, caught before the CRLF shows up
+	_, err = readWithLimits("GET /"+strings.Repeat("a", 100), limits)
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Too long, CRLF in the same read
+	_, err = readWithLimits("GET /"+strings.Repeat("a", 20)+" HTTP/1.1\r\n\r\n", limits)
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+}
+
+func TestLimits_Headers(t *testing.T) {
+	limits := Limits{MaxHeaderBytes: 64, MaxHeaderCount: 3}
+
+	// Test: Fits
+	_, err := readWithLimits("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", limits)
+	require.NoError(t, err)
+
+	// Test: Too many fields
+	_, err = readWithLimits("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n", limits)
+	assert.ErrorIs(t, err, ErrTooManyHeaders)
+
+	// Test: One huge field that never ends
+	_, err = readWithLimits("GET / HTTP/1.1\r\nCookie: "+strings.Repeat("x", 200), limits)
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Fields that are fine alone but too big together
+	_, err = readWithLimits("GET / HTTP/1.1\r\nA: "+strings.Repeat("x", 30)+"\r\nB: "+strings.Repeat("y", 30)+"\r\n\r\n", limits)
+	assert.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Trailers count separately
+	chunked := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nX: 1\r\nY: 2\r\nZ: 3\r\nW: 4\r\n\r\n"
+	_, err = readWithLimits(chunked, limits)
+	assert.ErrorIs(t, err, ErrTooManyHeaders)
+}
+
+func TestLimits_Body(t *testing.T) {
+	limits := Limits{MaxBodyBytes: 10}
+
+	// Test: Content-Length over the limit is refused before any body is read
+	reader := NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\n",
+		numBytesPerRead: 16,
+	}, limits)
+	_, err := reader.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: At the limit
+	r, err := readWithLimits("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789", limits)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(r.Body))
+
+	// Test: Chunked body going over while it's read
+	chunks := ""
+	for i := 0; i < 4; i++ {
+		chunks += fmt.Sprintf("3\r\n%03d\r\n", i)
+	}
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks + "0\r\n\r\n",
+		numBytesPerRead: 16,
+	}, limits)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+}
@@ -0,0 +1,182 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reader parses requests off a connection one after another.
+// Bytes read past the end of a request are kept for the next call to
+// ReadRequest, so pipelined requests sent back-to-back aren't lost.
+type Reader struct {
+	reader      io.Reader
+	buffer      []byte
+	readToIndex int
+	// body of the last request handed out, it may not be fully read yet
+	current *body
+	limits  Limits
+}
+
+// NewReader reads requests off reader within DefaultLimits.
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, DefaultLimits)
+}
+
+// Same as NewReader but with the given Limits, zero fields use the defaults.
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buffer: make([]byte, bufferSize),
+		limits: limits.withDefaults(),
+	}
+}
+
+// Reads the next request up to the end of its headers, the body is left on
+// the connection for Request.BodyReader. Any unread body of the previous
+// request is skipped first.
+// Returns io.EOF when the connection is closed cleanly between requests.
+func (r *Reader) ReadRequest() (*Request, error) {
+	if err := r.skipBody(); err != nil {
+		return nil, err
+	}
+
+	request := newRequest(r.limits)
+	for {
+		// parse what's already buffered first, it may hold a whole request
+		numBytesParsed, err := request.parse(r.buffered())
+		if err != nil {
+			return nil, err
+		}
+		r.consume(numBytesParsed)
+
+		if request.State > requestState_parsingHeaders {
+			r.current = &body{request: request, reader: r}
+			request.BodyReader = r.current
+			return request, nil
+		}
+
+		if err := r.fill(); err != nil {
+			if errors.Is(err, io.EOF) {
+				// connection closed before a new request started: not an
+				// error for the caller, just nothing more to read.
+				if request.State == requestState_initialized && r.readToIndex == 0 {
+					return nil, io.EOF
+				}
+				return nil, fmt.Errorf("%w: in state: %d, read n bytes on EOF: %d: %w", ErrIncompleteRequest, request.State, r.readToIndex, io.ErrUnexpectedEOF)
+			}
+			return nil, err
+		}
+	}
+}
+
+// WaitForData blocks until at least one byte of the next request is
+// buffered, so a caller can tell a connection sitting idle from a request
+// that's slow to arrive. Returns io.EOF if the connection closes first.
+func (r *Reader) WaitForData() error {
+	if err := r.skipBody(); err != nil {
+		return err
+	}
+	for r.readToIndex == 0 {
+		if err := r.fill(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasPrefix reports whether what comes next on the connection starts with
+// prefix, reading only as much as it takes to tell. It's for spotting
+// another protocol, the HTTP/2 preface say, before anything gets parsed.
+func (r *Reader) HasPrefix(prefix []byte) (bool, error) {
+	if err := r.skipBody(); err != nil {
+		return false, err
+	}
+	for {
+		n := min(r.readToIndex, len(prefix))
+		if !bytes.Equal(r.buffered()[:n], prefix[:n]) {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		if err := r.fill(); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Reads past whatever the previous request left of its body.
+func (r *Reader) skipBody() error {
+	if r.current == nil {
+		return nil
+	}
+	if err := r.current.discardAll(); err != nil {
+		return err
+	}
+	r.current = nil
+	return nil
+}
+
+// DiscardBody skips up to max bytes of the current request's unread body.
+// Returns false if there was more than that, in which case the connection
+// can't be reused without reading the rest.
+func (r *Reader) DiscardBody(max int) bool {
+	if r.current == nil {
+		return true
+	}
+	return r.current.discard(max)
+}
+
+// BodyErr returns the error reading the current request's body ended on,
+// nil if it hasn't failed. The server uses it to tell a body that went over
+// MaxBodyBytes apart from a handler's own failure.
+func (r *Reader) BodyErr() error {
+	if r.current == nil {
+		return nil
+	}
+	return r.current.err
+}
+
+// Buffered returns how many bytes have been read off the connection but not
+// parsed yet.
+func (r *Reader) Buffered() int {
+	return r.readToIndex
+}
+
+// Detach returns the bytes read off the connection but not parsed yet, for
+// a caller taking the connection over from the Reader. What the current
+// request's body reader hasn't read is in there too, or still on the
+// connection. The Reader can't be used after.
+func (r *Reader) Detach() []byte {
+	unread := append([]byte(nil), r.buffered()...)
+	r.readToIndex = 0
+	r.current = nil
+	return unread
+}
+
+func (r *Reader) buffered() []byte {
+	return r.buffer[:r.readToIndex]
+}
+
+// Purges parsed data by moving the unparsed bytes to the front.
+func (r *Reader) consume(n int) {
+	copy(r.buffer, r.buffer[n:r.readToIndex])
+	r.readToIndex -= n
+}
+
+// Reads more off the connection, growing the buffer when it's full.
+func (r *Reader) fill() error {
+	if r.readToIndex >= len(r.buffer) {
+		tmp := make([]byte, len(r.buffer)*2)
+		copy(tmp, r.buffer)
+		r.buffer = tmp
+	}
+	numBytesRead, err := r.reader.Read(r.buffer[r.readToIndex:])
+	r.readToIndex += numBytesRead
+	if numBytesRead > 0 {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package request
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReaderPipelined(t *testing.T) {
+	// Test: Back-to-back requests on one connection, bodies included
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n" +
+			"\r\n" + // stray empty line between requests is ignored
+			"GET /third HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Empty(t, r.Body)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+
+	// Test: Clean EOF between requests
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReaderIncomplete(t *testing.T) {
+	// Test: EOF in the middle of the second request is an error, not io.EOF
+	reader := NewReader(&chunkReader{
+		data:            "GET /first HTTP/1.1\r\n\r\nGET /sec",
+		numBytesPerRead: 64,
+	})
+	_, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, 8, reader.Buffered())
+
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestReaderStreamingBody(t *testing.T) {
+	// Test: Body is pulled off the reader in small pieces
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Content-Length: 26\r\n" +
+			"\r\n" +
+			"abcdefghijklmnopqrstuvwxyz" +
+			"GET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Empty(t, r.Body)
+
+	p := make([]byte, 4)
+	got := ""
+	for {
+		n, err := r.BodyReader.Read(p)
+		got += string(p[:n])
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.LessOrEqual(t, n, 4)
+	}
+	assert.Equal(t, "abcdefghijklmnopqrstuvwxyz", got)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestReaderSkipsUnreadBody(t *testing.T) {
+	// Test: A body the handler didn't read doesn't leak into the next request
+	reader := NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n5\r\nworld\r\n0\r\n\r\n" +
+			"GET /next HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 3,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	p := make([]byte, 3)
+	n, err := r.BodyReader.Read(p)
+	require.NoError(t, err)
+	assert.NotZero(t, n)
+	assert.True(t, strings.HasPrefix("hello", string(p[:n])))
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(p)
+	assert.ErrorIs(t, err, ErrBodyReadAfterClose)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestReaderDiscardBody(t *testing.T) {
+	data := "POST /upload HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789"
+
+	// Test: Short body fits the discard limit
+	reader := NewReader(&chunkReader{data: data, numBytesPerRead: 4})
+	_, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.True(t, reader.DiscardBody(10))
+
+	// Test: Body is longer than what we're willing to skip
+	reader = NewReader(&chunkReader{data: data, numBytesPerRead: 4})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.False(t, reader.DiscardBody(5))
+}
+
+func TestReaderWaitForData(t *testing.T) {
+	reader := NewReader(&chunkReader{
+		data:            "GET /first HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET /second HTTP/1.1\r\n\r\n",
+		numBytesPerRead: 4,
+	})
+	// Test: Returns once the first bytes are in
+	require.NoError(t, reader.WaitForData())
+	assert.Equal(t, 4, reader.Buffered())
+
+	// Test: Unread body isn't mistaken for the next request
+	_, err := reader.ReadRequest()
+	require.NoError(t, err)
+	require.NoError(t, reader.WaitForData())
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: EOF while waiting
+	assert.ErrorIs(t, reader.WaitForData(), io.EOF)
+}
+
+func TestReaderDetach(t *testing.T) {
+	reader := NewReader(strings.NewReader("GET /upgrade HTTP/1.1\r\nUpgrade: line\r\n\r\nHELLO\nBYE\n"))
+	_, err := reader.ReadRequest()
+	require.NoError(t, err)
+
+	// Test: what came in past the request is handed back
+	unread := reader.Detach()
+	assert.True(t, strings.HasPrefix("HELLO\nBYE\n", string(unread)))
+	assert.NotEmpty(t, unread)
+	assert.Equal(t, 0, reader.Buffered())
+	assert.Empty(t, reader.Detach())
+}
+
+func TestReaderHasPrefix(t *testing.T) {
+	preface := []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+	// Test: the prefix trickling in a byte at a time, and left buffered
+	reader := NewReader(&chunkReader{data: string(preface) + "frames", numBytesPerRead: 1})
+	ok, err := reader.HasPrefix(preface)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, len(preface), reader.Buffered())
+
+	// Test: a request that isn't it is told apart as soon as it differs
+	reader = NewReader(&chunkReader{data: "POST / HTTP/1.1\r\n\r\n", numBytesPerRead: 1})
+	ok, err = reader.HasPrefix(preface)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2, reader.Buffered())
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "POST", r.RequestLine.Method)
+
+	// Test: EOF before it's clear either way
+	reader = NewReader(strings.NewReader("PRI * HTTP"))
+	_, err = reader.HasPrefix(preface)
+	assert.ErrorIs(t, err, io.EOF)
+}
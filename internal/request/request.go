@@ -1,12 +1,9 @@
 package request
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
-	"strconv"
 	"strings"
 )
 
@@ -21,15 +18,30 @@ const (
 	requestState_initialized ParserState = iota
 	requestState_parsingHeaders
 	requestState_parsingBody
+	requestState_parsingChunkSize
+	requestState_parsingChunkData
+	requestState_parsingTrailers
 	requestState_done
 )
 
 type Request struct {
-	RequestLine    RequestLine
-	State          ParserState
-	Headers        headers.Headers
+	RequestLine RequestLine
+	Target      RequestTarget // RequestLine.RequestTarget, parsed
+	State       ParserState
+	Headers     *headers.Headers
+	// BodyReader streams the body off the connection as it's read, it's
+	// never nil. Body is only filled in by ReadBody.
+	BodyReader     io.ReadCloser
 	Body           []byte
+	Trailers       *headers.Headers  // fields sent after a chunked body
+	Params         map[string]string // path parameters captured by a router
+	contentLength  int
 	bodyLengthRead int
+	chunkRemaining int
+	expectContinue bool
+	limits         Limits
+	fieldBytes     int // size of the header or trailer section so far
+	fieldCount     int
 }
 
 // GET /coffee HTTP/1.1
@@ -39,91 +51,78 @@ type RequestLine struct {
 	Method        string
 }
 
+// Parses a single request from reader, body included.
+// Anything the reader returns past the end of the request is dropped, use a
+// Reader to parse several requests off the same connection.
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	// rawbytes, err := io.ReadAll(reader)
-	input_buffer := make([]byte, bufferSize)
-	readToIndex := 0
-	request := &Request{State: requestState_initialized,
-		Headers: headers.NewHeaders(),
-		Body:    make([]byte, 0),
-	}
-	for request.State != requestState_done { // I keep adding data into my buffer
-		if readToIndex >= len(input_buffer) {
-			tmp := make([]byte, len(input_buffer)*2)
-			copy(tmp, input_buffer)
-			input_buffer = tmp
-		}
-		numBytesRead, err := reader.Read(input_buffer[readToIndex:])
-		if err != nil {
-			if errors.Is(io.EOF, err) {
-				if request.State != requestState_done {
-					return nil, fmt.Errorf("incomplete request, in state: %d, read n bytes on EOF: %d", request.State, numBytesRead)
-				}
-				break
-			}
-			return nil, err
-
-		}
-		readToIndex += numBytesRead
-
-		// in the parser -> parseRequestLine, once I get to crlf I ingest the data.
-		numBytesParsed, err := request.parse(input_buffer[:readToIndex])
-		if err != nil {
-			return nil, err
-		}
-		// Now that I finally ingested the data and parsed it, I purge it.
-		// I just copy starting from what has been read to the end of the slice.
-		// remove that value from my starting index
-		copy(input_buffer, input_buffer[numBytesParsed:])
-		readToIndex -= numBytesParsed
-
+	request, err := NewReaderWithLimits(reader, DefaultLimits).ReadRequest()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := request.ReadBody(); err != nil {
+		return nil, err
 	}
-
 	return request, nil
 }
 
-func parseRequestLine(data []byte) (*RequestLine, int, error) {
-	idx := bytes.Index(data, []byte(crlf))
-	if idx == -1 {
-		// return nil, 0, fmt.Errorf("could not find CRLF in request-line")
-		return nil, 0, nil // no \r\n found yet
+func newRequest(limits Limits) *Request {
+	return &Request{State: requestState_initialized,
+		Headers:  headers.NewHeaders(),
+		Body:     make([]byte, 0),
+		Trailers: headers.NewHeaders(),
+		limits:   limits,
+	}
+}
+
+// NewRequest builds a request that didn't come off an HTTP/1 connection,
+// one from an HTTP/2 stream say. The method and target are checked like a
+// request-line's would be. body may be nil for a request without one.
+func NewRequest(method, target, version string, h *headers.Headers, body io.ReadCloser) (*Request, error) {
+	if err := checkMethod(method); err != nil {
+		return nil, err
 	}
-	requestLineText := string(data[:idx])
-	requestLine, err := requestLineFromString(requestLineText)
+	parsed, err := parseRequestTarget(method, target)
 	if err != nil {
-		return nil, 0, err
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTarget, err)
 	}
-
-	// +2 to skip the \r\n
-	return requestLine, idx + 2, nil
+	if body == nil {
+		body = io.NopCloser(strings.NewReader(""))
+	}
+	r := newRequest(DefaultLimits)
+	r.RequestLine = RequestLine{Method: method, RequestTarget: target, HttpVersion: version}
+	r.Target = *parsed
+	r.Headers = h
+	r.BodyReader = body
+	r.State = requestState_done
+	return r, nil
 }
 
 func requestLineFromString(str string) (*RequestLine, error) {
 	parts := strings.Split(str, " ")
 	if len(parts) != 3 {
-		return nil, fmt.Errorf("poorly formatted request-line: %s", str)
+		return nil, fmt.Errorf("%w: %q", ErrMalformedRequestLine, str)
 	}
 	method := parts[0]
-	for _, c := range method {
-		if c < 'A' || c > 'Z' {
-			return nil, fmt.Errorf("invalid method: %s", method)
-		}
+	if err := checkMethod(method); err != nil {
+		return nil, err
 	}
 
 	requestTarget := parts[1]
 
 	versionParts := strings.Split(parts[2], "/")
 	if len(versionParts) != 2 {
-		return nil, fmt.Errorf("malformed start-line: %s", str)
+		return nil, fmt.Errorf("%w: %q", ErrMalformedRequestLine, str)
 	}
 
+	// HTTP-version = HTTP-name "/" DIGIT "." DIGIT
 	httpPart := versionParts[0]
-	if httpPart != "HTTP" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", str)
-	}
 	version := versionParts[1]
-	if version != "1.1" {
-		return nil, fmt.Errorf("unrecognized HTTP-version: %s", str)
+	if httpPart != "HTTP" || len(version) != 3 || version[1] != '.' ||
+		!isDigit(version[0]) || !isDigit(version[2]) {
+		return nil, fmt.Errorf("%w: unrecognized HTTP-version: %q", ErrMalformedRequestLine, str)
+	}
+	if version != "1.1" && version != "1.0" {
+		return nil, fmt.Errorf("%w: HTTP/%s", ErrUnsupportedVersion, version)
 	}
 
 	return &RequestLine{
@@ -131,16 +130,30 @@ func requestLineFromString(str string) (*RequestLine, error) {
 	}, nil
 }
 
+func checkMethod(method string) error {
+	if method == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidMethod)
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("%w: %q", ErrInvalidMethod, method)
+		}
+	}
+	return nil
+}
+
 // accepts next slice of data to go into our request struct
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
 	for r.State != requestState_done {
+		state := r.State
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
 		}
 		totalBytesParsed += n
-		if n == 0 {
+		// nothing consumed and nowhere new to go: needs more data
+		if n == 0 && r.State == state {
 			break
 		}
 	}
@@ -150,50 +163,106 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.State {
 	case requestState_initialized:
-		requestLine, bytesConsumed, err := parseRequestLine(data)
+		line, bytesConsumed, err := headers.ReadLine(data, r.limits.Strict)
 		if err != nil {
-			return 0, fmt.Errorf("could not parse request: %s", err)
+			return 0, fmt.Errorf("could not parse request: %w: %w", ErrMalformedRequestLine, err)
 		}
 		if bytesConsumed == 0 {
+			if len(data) > r.limits.MaxRequestLineBytes {
+				return 0, ErrRequestLineTooLong
+			}
 			// more data needed
 			return 0, nil
 		}
+		// RFC 9112 2.2: ignore empty lines ahead of the request-line, some
+		// clients send an extra CRLF after a request body.
+		if len(line) == 0 {
+			return bytesConsumed, nil
+		}
+		if len(line) > r.limits.MaxRequestLineBytes {
+			return 0, ErrRequestLineTooLong
+		}
+		requestLine, err := requestLineFromString(string(line))
+		if err != nil {
+			return 0, fmt.Errorf("could not parse request: %w", err)
+		}
+		target, err := parseRequestTarget(requestLine.Method, requestLine.RequestTarget)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse request: %w: %w", ErrInvalidTarget, err)
+		}
 		r.RequestLine = *requestLine
+		r.Target = *target
 		r.State = requestState_parsingHeaders
 		return bytesConsumed, nil
 	case requestState_parsingHeaders:
-		bytesConsumed, done, err := r.Headers.Parse(data)
+		bytesConsumed, done, err := r.parseFields(r.Headers, data)
 		if err != nil {
-			return 0, fmt.Errorf("could not parse headers: %s", err)
+			return 0, fmt.Errorf("could not parse headers: %w: %w", ErrMalformedHeader, err)
+		}
+		if err := r.checkFieldLimits(data, bytesConsumed, done); err != nil {
+			return 0, err
 		}
 		if bytesConsumed == 0 {
 			return 0, nil
 		}
 		if done {
-			r.State = requestState_parsingBody
+			r.fieldBytes, r.fieldCount = 0, 0 // trailers get their own allowance
+			if err := r.checkExpect(); err != nil {
+				return 0, err
+			}
+			return bytesConsumed, r.startBody()
 		}
 		return bytesConsumed, nil
 	case requestState_parsingBody:
-		content_length_val, ok := r.Headers.Get("Content-length")
-		if !ok {
-			r.State = requestState_done
-			return len(data), nil
+		// body bytes are only taken by parseBody, when the handler reads them
+		return 0, nil
+	case requestState_parsingChunkSize:
+		size, bytesConsumed, err := parseChunkSize(data, r.limits.Strict)
+		if err != nil {
+			return 0, err
+		}
+		if bytesConsumed == 0 {
+			return 0, nil
+		}
+		if size == 0 {
+			r.State = requestState_parsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.State = requestState_parsingChunkData
 		}
-		content_length, err := strconv.Atoi(content_length_val)
+		return bytesConsumed, nil
+	case requestState_parsingChunkData:
+		if r.chunkRemaining > 0 {
+			return 0, nil // see requestState_parsingBody
+		}
+		// chunk data is followed by its own CRLF
+		line, n, err := headers.ReadLine(data, r.limits.Strict)
 		if err != nil {
-			return 0, fmt.Errorf("Malformed Content-length: %v\n\t%v", content_length_val, err)
+			return 0, fmt.Errorf("%w: %w", ErrMalformedChunk, err)
 		}
-
-		r.Body = append(r.Body, data...)
-		r.bodyLengthRead += len(data)
-		if r.bodyLengthRead > content_length {
-			return 0, fmt.Errorf("Content-length too larger")
+		if n == 0 && len(data) < len(crlf) {
+			return 0, nil
 		}
-
-		if content_length == r.bodyLengthRead {
+		if n == 0 || len(line) != 0 {
+			return 0, fmt.Errorf("%w: missing CRLF after chunk data", ErrMalformedChunk)
+		}
+		r.State = requestState_parsingChunkSize
+		return n, nil
+	case requestState_parsingTrailers:
+		bytesConsumed, done, err := r.parseFields(r.Trailers, data)
+		if err == nil && done {
+			err = checkTrailers(r.Trailers)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not parse trailers: %w: %w", ErrMalformedHeader, err)
+		}
+		if err := r.checkFieldLimits(data, bytesConsumed, done); err != nil {
+			return 0, err
+		}
+		if done {
 			r.State = requestState_done
 		}
-		return len(data), nil
+		return bytesConsumed, nil
 	case requestState_done:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	default:
@@ -201,6 +270,39 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 	}
 }
 
+func (r *Request) parseFields(h *headers.Headers, data []byte) (int, bool, error) {
+	if r.limits.Strict {
+		return h.ParseStrict(data)
+	}
+	return h.Parse(data)
+}
+
+// RFC 9110 10.1.1: 100-continue is the only expectation there is.
+func (r *Request) checkExpect() error {
+	expect, ok := r.Headers.Get("Expect")
+	if !ok || r.RequestLine.HttpVersion == "1.0" {
+		return nil // 1.0 clients can't be sent a 1xx anyway
+	}
+	if !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		return fmt.Errorf("%w: %q", ErrUnsupportedExpectation, expect)
+	}
+	r.expectContinue = true
+	return nil
+}
+
+// ExpectsContinue reports whether the client sent Expect: 100-continue and
+// is holding back the body until it gets a 100 Continue, or a final status
+// telling it not to bother. A request without a body never expects one.
+func (r *Request) ExpectsContinue() bool {
+	return r.expectContinue && r.State != requestState_done
+}
+
+// Param returns the path parameter captured under name, or "" if the route
+// didn't have one.
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
 func (r *Request) Print() {
 
 	fmt.Printf("Request line: \n- Method: %s\n- Target: %s\n- Version: %s\n",
@@ -209,9 +311,16 @@ func (r *Request) Print() {
 		r.RequestLine.HttpVersion)
 
 	fmt.Println("Headers:")
-	for key, val := range r.Headers {
-		fmt.Printf(" - %s: %s\n", key, val)
+	for _, f := range r.Headers.Fields() {
+		fmt.Printf(" - %s: %s\n", f.Name, f.Value)
 	}
 
 	fmt.Printf("Body:\n%v\n", string(r.Body))
+
+	if r.Trailers.Len() > 0 {
+		fmt.Println("Trailers:")
+		for _, f := range r.Trailers.Fields() {
+			fmt.Printf(" - %s: %s\n", f.Name, f.Value)
+		}
+	}
 }
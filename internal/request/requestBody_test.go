@@ -75,3 +75,98 @@ func TestRequestBodyParse_NoContentWithBody(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, r)
 }
+
+func TestRequestBodyParse_Chunked(t *testing.T) {
+	// Test: Chunked body with extensions and trailers
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"6\r\n" +
+			"hello \r\n" +
+			"7;ext=\"val\";flag\r\n" +
+			"world!\n\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!\n", string(r.Body))
+	val, ok := r.Trailers.Get("X-Checksum")
+	assert.True(t, ok)
+	assert.Equal(t, "abc123", val)
+
+	// Test: trailers that aren't allowed but don't touch framing or
+	// routing are dropped, the request goes on
+	reader = &chunkReader{
+		data: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\n" +
+			"Cache-Control: no-cache\r\nX-Checksum: abc123\r\nContent-Type: text/plain\r\n\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(r.Body))
+	assert.Equal(t, 1, r.Trailers.Len())
+	val, _ = r.Trailers.Get("X-Checksum")
+	assert.Equal(t, "abc123", val)
+}
+
+func TestRequestBodyParse_ChunkedNoTrailers(t *testing.T) {
+	// Test: Chunked body followed by a pipelined request
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A\r\n" +
+			"0123456789\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"GET /next HTTP/1.1\r\n" +
+			"\r\n",
+		numBytesPerRead: 64,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(body))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+}
+
+func TestRequestBodyParse_ChunkedMalformed(t *testing.T) {
+	for _, body := range []string{
+		"zz\r\nhello\r\n0\r\n\r\n",      // size isn't hex
+		"5\r\nhello!!\r\n0\r\n\r\n",     // data longer than the chunk size
+		"5\r\nhello\r\n0\r\n",           // body cut off before the last CRLF
+		"5;=x\r\nhello\r\n0\r\n\r\n",    // extension without a name
+		"ffffffffffffffff\r\nhello\r\n", // size overflows
+	} {
+		reader := &chunkReader{
+			data: "POST /submit HTTP/1.1\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" + body,
+			numBytesPerRead: 3,
+		}
+		_, err := RequestFromReader(reader)
+		require.Error(t, err, body)
+	}
+
+	// Test: chunked has to be the final coding
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Transfer-Encoding: chunked, gzip\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err := RequestFromReader(reader)
+	require.Error(t, err)
+}
@@ -1,7 +1,9 @@
 package request
 
 import (
+	"httpfromtcp/internal/headers"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,6 +71,26 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.Error(t, err)
 
+	// Test: HTTP/1.0 Request line
+	reader = &chunkReader{
+		data:            "GET / HTTP/1.0\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
+	// Test: Unsupported version in Request line
+	for _, version := range []string{"HTTP/0.9", "HTTP/1.2", "HTTP/2.0"} {
+		r, err = RequestFromReader(strings.NewReader("GET / " + version + "\r\n\r\n"))
+		require.ErrorIs(t, err, ErrUnsupportedVersion)
+	}
+
+	// Test: Transfer-Encoding in an HTTP/1.0 request
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	require.ErrorIs(t, err, ErrInvalidTransferCoding)
+
 	// Test: Standard Headers
 	reader = &chunkReader{
 		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n",
@@ -77,9 +99,9 @@ func TestRequestLineParse(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// Test: Empty Header
 	reader = &chunkReader{
@@ -103,7 +125,16 @@ func TestRequestLineParse(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
-	require.Equal(t, "localhost:42069", r.Headers["host"])
+	require.NoError(t, err)
+	// every field line is kept, even repeats
+	require.Equal(t, []string{"localhost:42069", "localhost:42069"}, r.Headers.Values("host"))
+	require.Equal(t, "localhost:42069, localhost:42069", get(r.Headers, "host"))
+}
+
+// get returns the combined value of key, "" when it's missing.
+func get(h *headers.Headers, key string) string {
+	val, _ := h.Get(key)
+	return val
 }
 
 type chunkReader struct {
@@ -128,3 +159,25 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+func TestNewRequest(t *testing.T) {
+	// Test: a request built from parts, without a body
+	h := headers.NewHeaders()
+	h.Set("Host", "localhost")
+	r, err := NewRequest("GET", "/coffee?cups=2", "2.0", h, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.Target.Path)
+	assert.Equal(t, "2", r.Target.Query.Get("cups"))
+	assert.Equal(t, "2.0", r.RequestLine.HttpVersion)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+
+	// Test: method and target are checked like a request-line's
+	_, err = NewRequest("get", "/", "2.0", h, nil)
+	assert.ErrorIs(t, err, ErrInvalidMethod)
+	_, err = NewRequest("", "/", "2.0", h, nil)
+	assert.ErrorIs(t, err, ErrInvalidMethod)
+	_, err = NewRequest("GET", "*", "2.0", h, nil)
+	assert.ErrorIs(t, err, ErrInvalidTarget)
+}
@@ -0,0 +1,208 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The four shapes a request-target can take, RFC 9112 3.2.
+type TargetForm int
+
+const (
+	TargetFormOrigin    TargetForm = iota // /where?q=now
+	TargetFormAbsolute                    // http://www.example.org/pub/WWW/
+	TargetFormAuthority                   // www.example.com:80, CONNECT only
+	TargetFormAsterisk                    // *, OPTIONS only
+)
+
+// RequestTarget is the request-target broken into its components.
+// The raw string is still in RequestLine.RequestTarget.
+type RequestTarget struct {
+	Form      TargetForm
+	Scheme    string // absolute-form only
+	Authority string // absolute-form and authority-form
+	Path      string // percent-decoded
+	RawPath   string // as sent, still escaped
+	RawQuery  string // without the '?'
+	Query     Query
+	Fragment  string // clients shouldn't send one, but some do
+}
+
+// Query maps each key to all of its values, in the order they were sent.
+type Query map[string][]string
+
+// Get returns the first value for key, or "" if there isn't one.
+func (q Query) Get(key string) string {
+	if vals := q[key]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Has reports whether key was in the query at all, even without a value.
+func (q Query) Has(key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+func parseRequestTarget(method, target string) (*RequestTarget, error) {
+	if target == "" {
+		return nil, fmt.Errorf("empty request-target")
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return nil, fmt.Errorf("invalid character in request-target: %q", target)
+		}
+	}
+
+	rt := &RequestTarget{}
+	switch {
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("asterisk-form is only allowed for OPTIONS: %s", target)
+		}
+		rt.Form = TargetFormAsterisk
+		rt.RawPath = target
+		rt.Path = target
+		rt.Query = Query{}
+		return rt, nil
+	case method == "CONNECT":
+		// authority-form is the only form allowed for CONNECT
+		if !validAuthority(target) || !strings.Contains(target, ":") {
+			return nil, fmt.Errorf("invalid authority-form: %s", target)
+		}
+		rt.Form = TargetFormAuthority
+		rt.Authority = target
+		rt.Query = Query{}
+		return rt, nil
+	case strings.HasPrefix(target, "/"):
+		rt.Form = TargetFormOrigin
+	default:
+		scheme, rest, found := strings.Cut(target, "://")
+		if !found || !validScheme(scheme) {
+			return nil, fmt.Errorf("unrecognized request-target: %s", target)
+		}
+		authorityEnd := strings.IndexAny(rest, "/?#")
+		if authorityEnd == -1 {
+			authorityEnd = len(rest)
+		}
+		rt.Form = TargetFormAbsolute
+		rt.Scheme = strings.ToLower(scheme)
+		rt.Authority = rest[:authorityEnd]
+		if !validAuthority(rt.Authority) {
+			return nil, fmt.Errorf("invalid authority in request-target: %s", target)
+		}
+		target = rest[authorityEnd:]
+	}
+
+	target, rt.Fragment, _ = strings.Cut(target, "#")
+	rt.RawPath, rt.RawQuery, _ = strings.Cut(target, "?")
+	if rt.RawPath == "" {
+		// absolute-form with an empty path means the root
+		rt.RawPath = "/"
+	}
+
+	path, err := percentDecode(rt.RawPath, false)
+	if err != nil {
+		return nil, err
+	}
+	rt.Path = path
+	rt.Query, err = parseQuery(rt.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// Splits a query like "a=1&b=2&a=3" into its values, '+' reads as a space.
+func parseQuery(rawQuery string) (Query, error) {
+	query := Query{}
+	if rawQuery == "" {
+		return query, nil
+	}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		rawKey, rawVal, _ := strings.Cut(pair, "=")
+		key, err := percentDecode(rawKey, true)
+		if err != nil {
+			return nil, err
+		}
+		val, err := percentDecode(rawVal, true)
+		if err != nil {
+			return nil, err
+		}
+		query[key] = append(query[key], val)
+	}
+	return query, nil
+}
+
+// PathUnescape percent-decodes a piece of a RawPath, like a single segment
+// of it. Unlike query values, '+' stays a '+'.
+func PathUnescape(s string) (string, error) {
+	return percentDecode(s, false)
+}
+
+func percentDecode(s string, plusAsSpace bool) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return "", fmt.Errorf("invalid percent-encoding: %q", s)
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case c == '+' && plusAsSpace:
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." )
+func validScheme(scheme string) bool {
+	if scheme == "" {
+		return false
+	}
+	for i := 0; i < len(scheme); i++ {
+		c := scheme[i]
+		isAlpha := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if i == 0 && !isAlpha {
+			return false
+		}
+		if !isAlpha && !(c >= '0' && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func validAuthority(authority string) bool {
+	return authority != "" && !strings.ContainsAny(authority, "/?#@")
+}
@@ -0,0 +1,85 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestTargetParse(t *testing.T) {
+	// Test: origin-form with a multi-valued query
+	reader := &chunkReader{
+		data:            "GET /video?x=1&tag=a&tag=b+c&flag HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "/video?x=1&tag=a&tag=b+c&flag", r.RequestLine.RequestTarget)
+	assert.Equal(t, TargetFormOrigin, r.Target.Form)
+	assert.Equal(t, "/video", r.Target.Path)
+	assert.Equal(t, "x=1&tag=a&tag=b+c&flag", r.Target.RawQuery)
+	assert.Equal(t, "1", r.Target.Query.Get("x"))
+	assert.Equal(t, []string{"a", "b c"}, r.Target.Query["tag"])
+	assert.True(t, r.Target.Query.Has("flag"))
+	assert.False(t, r.Target.Query.Has("missing"))
+
+	// Test: Percent-encoded path keeps the raw form around
+	target, err := parseRequestTarget("GET", "/files/a%20b%2Fc?q=%E2%9C%93#top")
+	require.NoError(t, err)
+	assert.Equal(t, "/files/a b/c", target.Path)
+	assert.Equal(t, "/files/a%20b%2Fc", target.RawPath)
+	assert.Equal(t, "✓", target.Query.Get("q"))
+	assert.Equal(t, "top", target.Fragment)
+
+	// Test: absolute-form
+	target, err = parseRequestTarget("GET", "http://www.example.org/pub/WWW/TheProject.html?a=b")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAbsolute, target.Form)
+	assert.Equal(t, "http", target.Scheme)
+	assert.Equal(t, "www.example.org", target.Authority)
+	assert.Equal(t, "/pub/WWW/TheProject.html", target.Path)
+	assert.Equal(t, "b", target.Query.Get("a"))
+
+	// Test: absolute-form without a path
+	target, err = parseRequestTarget("GET", "http://example.com:8080")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:8080", target.Authority)
+	assert.Equal(t, "/", target.Path)
+
+	// Test: authority-form
+	target, err = parseRequestTarget("CONNECT", "www.example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAuthority, target.Form)
+	assert.Equal(t, "www.example.com:443", target.Authority)
+
+	// Test: asterisk-form
+	target, err = parseRequestTarget("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAsterisk, target.Form)
+}
+
+func TestRequestTargetParse_Invalid(t *testing.T) {
+	for _, tc := range []struct{ method, target string }{
+		{"GET", "*"},                   // asterisk-form outside OPTIONS
+		{"GET", "coffee"},              // not a path, not a URI
+		{"GET", "/bad%zzescape"},       // bad percent-encoding
+		{"GET", "/trailing%2"},         // truncated percent-encoding
+		{"GET", "/query?a=%"},          // bad escape in the query
+		{"GET", "1http://example.com"}, // scheme must start with a letter
+		{"GET", "http:///path"},        // empty authority
+		{"CONNECT", "/path"},           // CONNECT needs host:port
+		{"GET", "/nul\x00"},            // control characters
+	} {
+		_, err := parseRequestTarget(tc.method, tc.target)
+		assert.Error(t, err, tc.target)
+	}
+
+	// Test: Bad target fails the whole request
+	reader := &chunkReader{
+		data:            "GET coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err := RequestFromReader(reader)
+	require.Error(t, err)
+}
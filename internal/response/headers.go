@@ -1,26 +1,38 @@
 package response
 
 import (
+	"bytes"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
 )
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
+// Connection is left to the Writer, which knows whether the server intends to
+// keep the connection open after this response.
+func GetDefaultHeaders(contentLen int) *headers.Headers {
 	defaultHeader := headers.NewHeaders()
 	defaultHeader.Set("Content-Length", fmt.Sprintf("%d", contentLen))
-	defaultHeader.Set("Connection", "close")
 	defaultHeader.Set("Content-Type", "text/plain")
 	return defaultHeader
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for key, val := range headers {
-		_, err := w.Write([]byte(fmt.Sprintf("%s: %s%s", key, val, crlf)))
-		if err != nil {
+// WriteHeaders writes one line per field in the order they were added, with
+// canonical names, then the blank line ending the section. Repeated fields
+// like Set-Cookie stay on their own lines. The same headers always give the
+// same bytes. A field that fails headers.ValidateField is an error and
+// nothing is written.
+func WriteHeaders(w io.Writer, h *headers.Headers) error {
+	var buf bytes.Buffer
+	for _, f := range h.Fields() {
+		if err := headers.ValidateField(f.Name, f.Value); err != nil {
 			return err
 		}
+		buf.WriteString(headers.CanonicalKey(f.Name))
+		buf.WriteString(": ")
+		buf.WriteString(f.Value)
+		buf.WriteString(crlf)
 	}
-	_, err := w.Write([]byte(crlf))
+	buf.WriteString(crlf)
+	_, err := w.Write(buf.Bytes())
 	return err
 }
@@ -0,0 +1,115 @@
+package response
+
+import (
+	"bytes"
+	"httpfromtcp/internal/headers"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHeaders(t *testing.T) {
+	// Test: insertion order, canonical names, one line per value
+	h := GetDefaultHeaders(5)
+	h.Add("set-cookie", "a=1")
+	h.Add("SET-COOKIE", "b=2; Path=/")
+	h.Set("x-request-id", "abc")
+	want := "Content-Length: 5\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Set-Cookie: a=1\r\n" +
+		"Set-Cookie: b=2; Path=/\r\n" +
+		"X-Request-Id: abc\r\n" +
+		"\r\n"
+	for range 10 {
+		var buf bytes.Buffer
+		require.NoError(t, WriteHeaders(&buf, h))
+		assert.Equal(t, want, buf.String())
+	}
+
+	// Test: the whole response through the Writer is reproducible
+	var first []byte
+	for range 10 {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetKeepAlive(true)
+		w.SetHeader("vary", "Origin")
+		w.WriteStatusLine(StatusCodeSuccess)
+		w.WriteHeaders(GetDefaultHeaders(2))
+		w.WriteBody([]byte("hi"))
+		w.Finish()
+		if first == nil {
+			first = buf.Bytes()
+		}
+		assert.Equal(t, first, buf.Bytes())
+	}
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Type: text/plain\r\nVary: Origin\r\n\r\nhi", string(first))
+
+	// Test: empty headers are just the blank line
+	var buf bytes.Buffer
+	require.NoError(t, WriteHeaders(&buf, headers.NewHeaders()))
+	assert.Equal(t, "\r\n", buf.String())
+}
+
+func TestWriteHeadersRejectsInjection(t *testing.T) {
+	// Test: a value that would add a field line writes nothing
+	h := GetDefaultHeaders(0)
+	h.Set("Location", "/next\r\nSet-Cookie: evil=1")
+	var buf bytes.Buffer
+	err := WriteHeaders(&buf, h)
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.Empty(t, buf.String())
+
+	// Test: the Writer sends a plain 500 instead, the handler's body is
+	// refused
+	buf.Reset()
+	w := NewWriter(&buf)
+	w.SetKeepAlive(true)
+	w.WriteStatusLine(StatusCodeSuccess)
+	err = w.WriteHeaders(h)
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	_, err = w.Write([]byte("body"))
+	assert.Error(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 21\r\nContent-Type: text/plain\r\n\r\nInternal Server Error", buf.String())
+	assert.False(t, w.Aborted())
+	assert.True(t, w.KeepAlive())
+
+	// Test: same for headers held back until the handler is done
+	buf.Reset()
+	w = NewWriter(&buf)
+	bad := headers.NewHeaders()
+	bad.Set("X-Bad", "a\rb")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(bad)
+	w.Write([]byte("body"))
+	assert.ErrorIs(t, w.Finish(), headers.ErrInvalidFieldValue)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\nContent-Length: 21\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\nInternal Server Error", buf.String())
+
+	// Test: it gives up on the response once the status line is out
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetKeepAlive(true)
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.Flush()
+	err = w.WriteHeaders(h)
+	assert.ErrorIs(t, err, headers.ErrInvalidFieldValue)
+	assert.True(t, w.Aborted())
+	assert.False(t, w.KeepAlive())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	// Test: bad trailers are dropped but the body still ends
+	buf.Reset()
+	w = NewWriter(&buf)
+	chunked := headers.NewHeaders()
+	chunked.Set("Transfer-Encoding", "chunked")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(chunked)
+	w.WriteChunkedBodyDone()
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "1\n2")
+	assert.ErrorIs(t, w.WriteTrailers(trailers), headers.ErrInvalidFieldValue)
+	require.NoError(t, w.Finish())
+	assert.True(t, bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n0\r\n\r\n")))
+}
@@ -0,0 +1,54 @@
+package response
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrNotHijackable is returned by Hijack when the server can't hand the
+	// connection over, e.g. while it's pipelining requests.
+	ErrNotHijackable = errors.New("connection can't be hijacked")
+	// ErrHijacked is returned by writes after Hijack.
+	ErrHijacked = errors.New("connection has been hijacked")
+)
+
+// SetHijacker is called by the server with the function that hands over
+// the connection. Writers without one can't be hijacked.
+func (w *Writer) SetHijacker(hijacker func() (net.Conn, []byte, error)) {
+	w.hijacker = hijacker
+}
+
+// Hijack takes the connection over from the server, for protocols like
+// WebSocket that only start out as HTTP. Whatever was written so far is
+// flushed first. Along with the connection come the bytes the server
+// already read off it past the request, they have to be handled before
+// reading from the connection.
+//
+// After that the Writer can't be used and the server leaves the connection
+// alone: no more timeouts, Shutdown doesn't wait for it or close it, and
+// closing it is up to the caller. It has to be called from the handler,
+// before the response is finished.
+func (w *Writer) Hijack() (net.Conn, []byte, error) {
+	if w.WriterState == WriteHijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.hijacker == nil || w.WriterState == WriteFinished {
+		return nil, nil, ErrNotHijackable
+	}
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	conn, buffered, err := w.hijacker()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.WriterState = WriteHijacked
+	w.keepAlive = false
+	return conn, buffered, nil
+}
+
+// Hijacked reports whether Hijack took the connection over.
+func (w *Writer) Hijacked() bool {
+	return w.WriterState == WriteHijacked
+}
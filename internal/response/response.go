@@ -1,7 +1,6 @@
 package response
 
 import (
-	"fmt"
 	"io"
 )
 
@@ -9,29 +8,14 @@ const (
 	crlf = "\r\n"
 )
 
-type StatusCode int
-
-const (
-	StatusCodeSuccess             StatusCode = 200
-	StatusCodeBadRequest          StatusCode = 400
-	StatusCodeInternalServerError StatusCode = 500
-)
-
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	_, err := w.Write(getStatusLine(statusCode))
+	if err := validateStatusCode(statusCode); err != nil {
+		return err
+	}
+	_, err := w.Write(getStatusLine("1.1", statusCode))
 	return err
 }
 
-func getStatusLine(statusCode StatusCode) []byte {
-	responsePhrase := ""
-	switch statusCode {
-	case StatusCodeSuccess:
-		responsePhrase += "OK"
-	case StatusCodeBadRequest:
-		responsePhrase += "Bad Request"
-	case StatusCodeInternalServerError:
-		responsePhrase += "Internal Server Error"
-	}
-
-	return []byte(fmt.Sprintf("HTTP/1.1 %d %s%s", statusCode, responsePhrase, crlf))
+func getStatusLine(version string, statusCode StatusCode) []byte {
+	return StatusLine{HttpVersion: version, Code: statusCode}.bytes()
 }
@@ -0,0 +1,186 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is one Server-Sent Event. Data may span several lines, each one
+// goes out as its own data: field. Empty fields are left out.
+type Event struct {
+	Event string // event type, "message" on the client when empty
+	ID    string
+	Data  string
+	Retry time.Duration // reconnection delay, sent in milliseconds
+}
+
+// ErrInvalidEventField is an event type or id with a line break in it,
+// which would end the field early and let the rest be read as a new one.
+var ErrInvalidEventField = errors.New("invalid event field")
+
+// EventStream writes a text/event-stream response, flushing each event as
+// it's sent. It serializes its own writes, so events can be sent from
+// several goroutines, but the handler shouldn't touch the Writer directly
+// once the stream is open.
+//
+// A client going away only shows up as a failed write. Done is closed then
+// and every later Send fails, sending keep-alives makes sure it's noticed
+// on a stream that's otherwise quiet.
+type EventStream struct {
+	mu   sync.Mutex
+	w    *Writer
+	err  error
+	done chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewEventStream sends the headers for an event stream and starts writing
+// a keep-alive comment every keepAlive, zero turns them off. Close the
+// stream before the handler returns.
+func NewEventStream(w *Writer, keepAlive time.Duration) (*EventStream, error) {
+	s := &EventStream{
+		w:    w,
+		done: make(chan struct{}),
+		stop: make(chan struct{}),
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	if err := w.WriteStatusLine(StatusCodeSuccess); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	if err := s.flush(); err != nil {
+		return nil, err
+	}
+	if keepAlive > 0 {
+		s.wg.Add(1)
+		go s.keepAlive(keepAlive)
+	}
+	return s, nil
+}
+
+func (s *EventStream) keepAlive(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.Comment("keep-alive") != nil {
+				return
+			}
+		case <-s.stop:
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Send writes ev and flushes it to the client.
+func (s *EventStream) Send(ev Event) error {
+	if strings.ContainsAny(ev.Event, "\r\n") || strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return fmt.Errorf("%w: event %q, id %q", ErrInvalidEventField, ev.Event, ev.ID)
+	}
+	var b strings.Builder
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", ev.Retry.Milliseconds())
+	}
+	if ev.Data != "" || ev.Event != "" {
+		for _, line := range splitLines(ev.Data) {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, ignored by the client. Useful to keep
+// proxies from timing out an idle stream.
+func (s *EventStream) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range splitLines(text) {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+func (s *EventStream) write(frame string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := s.w.Write([]byte(frame)); err != nil {
+		return s.fail(err)
+	}
+	return s.flushLocked()
+}
+
+func (s *EventStream) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *EventStream) flushLocked() error {
+	if err := s.w.Flush(); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// fail records the first write error and closes done, the stream's of no
+// use after that.
+func (s *EventStream) fail(err error) error {
+	if s.err == nil {
+		s.err = err
+		close(s.done)
+	}
+	return s.err
+}
+
+// Done is closed once a write fails, most likely the client disconnected.
+func (s *EventStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the write error that closed Done, nil while the stream's fine.
+func (s *EventStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close stops the keep-alives and waits for them to be done with the
+// Writer. It doesn't end the response, the server does that once the
+// handler returns.
+func (s *EventStream) Close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.wg.Wait()
+}
+
+// Data and comments can't hold a line break, each line is a field of its
+// own. CRLF, CR and LF all end a line in an event stream.
+func splitLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	return strings.Split(text, "\n")
+}
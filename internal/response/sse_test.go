@@ -0,0 +1,92 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedBuffer lets the test read what the keep-alive goroutine wrote.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+	err error
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestEventStream(t *testing.T) {
+	w, buf := newTestWriter("1.1")
+	s, err := NewEventStream(w, 0)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: the headers go out straight away
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nTransfer-Encoding: chunked\r\n\r\n", buf.String())
+
+	// Test: every field, one chunk per event
+	buf.Reset()
+	require.NoError(t, s.Send(Event{Event: "update", ID: "7", Data: "hello", Retry: 3 * time.Second}))
+	frame := "event: update\nid: 7\nretry: 3000\ndata: hello\n\n"
+	assert.Equal(t, fmt.Sprintf("%x\r\n%s\r\n", len(frame), frame), buf.String())
+
+	// Test: each line of the data is its own field, whatever ends it
+	buf.Reset()
+	require.NoError(t, s.Send(Event{Data: "a\nb\r\nc\rd"}))
+	assert.Contains(t, buf.String(), "data: a\ndata: b\ndata: c\ndata: d\n\n")
+
+	// Test: a line break can't sneak into the event type or id
+	buf.Reset()
+	assert.ErrorIs(t, s.Send(Event{Event: "x\ndata: evil"}), ErrInvalidEventField)
+	assert.ErrorIs(t, s.Send(Event{ID: "1\r2", Data: "x"}), ErrInvalidEventField)
+	assert.Empty(t, buf.String())
+
+	// Test: comments
+	require.NoError(t, s.Comment("one\ntwo"))
+	assert.Contains(t, buf.String(), ": one\n: two\n\n")
+}
+
+func TestEventStreamKeepAlive(t *testing.T) {
+	var buf lockedBuffer
+	w := NewWriter(&buf)
+	s, err := NewEventStream(w, 5*time.Millisecond)
+	require.NoError(t, err)
+
+	// Test: idle streams get keep-alive comments
+	assert.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), ": keep-alive\n\n")
+	}, time.Second, 5*time.Millisecond)
+
+	// Test: a failed write means the client's gone
+	gone := errors.New("connection reset")
+	buf.mu.Lock()
+	buf.err = gone
+	buf.mu.Unlock()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream not done after the client went away")
+	}
+	assert.ErrorIs(t, s.Err(), gone)
+	assert.ErrorIs(t, s.Send(Event{Data: "late"}), gone)
+	s.Close()
+}
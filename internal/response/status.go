@@ -0,0 +1,200 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidStatusCode   = errors.New("invalid status code")
+	ErrInvalidReasonPhrase = errors.New("invalid reason phrase")
+)
+
+type StatusCode int
+
+// The IANA HTTP Status Code Registry, RFC 9110 15 and the RFCs it points to.
+const (
+	StatusCodeContinue           StatusCode = 100
+	StatusCodeSwitchingProtocols StatusCode = 101
+	StatusCodeProcessing         StatusCode = 102
+	StatusCodeEarlyHints         StatusCode = 103
+
+	StatusCodeSuccess                     StatusCode = 200
+	StatusCodeCreated                     StatusCode = 201
+	StatusCodeAccepted                    StatusCode = 202
+	StatusCodeNonAuthoritativeInformation StatusCode = 203
+	StatusCodeNoContent                   StatusCode = 204
+	StatusCodeResetContent                StatusCode = 205
+	StatusCodePartialContent              StatusCode = 206
+	StatusCodeMultiStatus                 StatusCode = 207
+	StatusCodeAlreadyReported             StatusCode = 208
+	StatusCodeIMUsed                      StatusCode = 226
+
+	StatusCodeMultipleChoices   StatusCode = 300
+	StatusCodeMovedPermanently  StatusCode = 301
+	StatusCodeFound             StatusCode = 302
+	StatusCodeSeeOther          StatusCode = 303
+	StatusCodeNotModified       StatusCode = 304
+	StatusCodeUseProxy          StatusCode = 305
+	StatusCodeTemporaryRedirect StatusCode = 307
+	StatusCodePermanentRedirect StatusCode = 308
+
+	StatusCodeBadRequest                    StatusCode = 400
+	StatusCodeUnauthorized                  StatusCode = 401
+	StatusCodePaymentRequired               StatusCode = 402
+	StatusCodeForbidden                     StatusCode = 403
+	StatusCodeNotFound                      StatusCode = 404
+	StatusCodeMethodNotAllowed              StatusCode = 405
+	StatusCodeNotAcceptable                 StatusCode = 406
+	StatusCodeProxyAuthRequired             StatusCode = 407
+	StatusCodeRequestTimeout                StatusCode = 408
+	StatusCodeConflict                      StatusCode = 409
+	StatusCodeGone                          StatusCode = 410
+	StatusCodeLengthRequired                StatusCode = 411
+	StatusCodePreconditionFailed            StatusCode = 412
+	StatusCodeContentTooLarge               StatusCode = 413
+	StatusCodeURITooLong                    StatusCode = 414
+	StatusCodeUnsupportedMediaType          StatusCode = 415
+	StatusCodeRangeNotSatisfiable           StatusCode = 416
+	StatusCodeExpectationFailed             StatusCode = 417
+	StatusCodeMisdirectedRequest            StatusCode = 421
+	StatusCodeUnprocessableContent          StatusCode = 422
+	StatusCodeLocked                        StatusCode = 423
+	StatusCodeFailedDependency              StatusCode = 424
+	StatusCodeTooEarly                      StatusCode = 425
+	StatusCodeUpgradeRequired               StatusCode = 426
+	StatusCodePreconditionRequired          StatusCode = 428
+	StatusCodeTooManyRequests               StatusCode = 429
+	StatusCodeHeaderTooLarge                StatusCode = 431
+	StatusCodeUnavailableForLegalReasons    StatusCode = 451
+	StatusCodeInternalServerError           StatusCode = 500
+	StatusCodeNotImplemented                StatusCode = 501
+	StatusCodeBadGateway                    StatusCode = 502
+	StatusCodeServiceUnavailable            StatusCode = 503
+	StatusCodeGatewayTimeout                StatusCode = 504
+	StatusCodeHTTPVersionNotSupported       StatusCode = 505
+	StatusCodeVariantAlsoNegotiates         StatusCode = 506
+	StatusCodeInsufficientStorage           StatusCode = 507
+	StatusCodeLoopDetected                  StatusCode = 508
+	StatusCodeNotExtended                   StatusCode = 510
+	StatusCodeNetworkAuthenticationRequired StatusCode = 511
+)
+
+var statusText = map[StatusCode]string{
+	StatusCodeContinue:           "Continue",
+	StatusCodeSwitchingProtocols: "Switching Protocols",
+	StatusCodeProcessing:         "Processing",
+	StatusCodeEarlyHints:         "Early Hints",
+
+	StatusCodeSuccess:                     "OK",
+	StatusCodeCreated:                     "Created",
+	StatusCodeAccepted:                    "Accepted",
+	StatusCodeNonAuthoritativeInformation: "Non-Authoritative Information",
+	StatusCodeNoContent:                   "No Content",
+	StatusCodeResetContent:                "Reset Content",
+	StatusCodePartialContent:              "Partial Content",
+	StatusCodeMultiStatus:                 "Multi-Status",
+	StatusCodeAlreadyReported:             "Already Reported",
+	StatusCodeIMUsed:                      "IM Used",
+
+	StatusCodeMultipleChoices:   "Multiple Choices",
+	StatusCodeMovedPermanently:  "Moved Permanently",
+	StatusCodeFound:             "Found",
+	StatusCodeSeeOther:          "See Other",
+	StatusCodeNotModified:       "Not Modified",
+	StatusCodeUseProxy:          "Use Proxy",
+	StatusCodeTemporaryRedirect: "Temporary Redirect",
+	StatusCodePermanentRedirect: "Permanent Redirect",
+
+	StatusCodeBadRequest:                    "Bad Request",
+	StatusCodeUnauthorized:                  "Unauthorized",
+	StatusCodePaymentRequired:               "Payment Required",
+	StatusCodeForbidden:                     "Forbidden",
+	StatusCodeNotFound:                      "Not Found",
+	StatusCodeMethodNotAllowed:              "Method Not Allowed",
+	StatusCodeNotAcceptable:                 "Not Acceptable",
+	StatusCodeProxyAuthRequired:             "Proxy Authentication Required",
+	StatusCodeRequestTimeout:                "Request Timeout",
+	StatusCodeConflict:                      "Conflict",
+	StatusCodeGone:                          "Gone",
+	StatusCodeLengthRequired:                "Length Required",
+	StatusCodePreconditionFailed:            "Precondition Failed",
+	StatusCodeContentTooLarge:               "Content Too Large",
+	StatusCodeURITooLong:                    "URI Too Long",
+	StatusCodeUnsupportedMediaType:          "Unsupported Media Type",
+	StatusCodeRangeNotSatisfiable:           "Range Not Satisfiable",
+	StatusCodeExpectationFailed:             "Expectation Failed",
+	StatusCodeMisdirectedRequest:            "Misdirected Request",
+	StatusCodeUnprocessableContent:          "Unprocessable Content",
+	StatusCodeLocked:                        "Locked",
+	StatusCodeFailedDependency:              "Failed Dependency",
+	StatusCodeTooEarly:                      "Too Early",
+	StatusCodeUpgradeRequired:               "Upgrade Required",
+	StatusCodePreconditionRequired:          "Precondition Required",
+	StatusCodeTooManyRequests:               "Too Many Requests",
+	StatusCodeHeaderTooLarge:                "Request Header Fields Too Large",
+	StatusCodeUnavailableForLegalReasons:    "Unavailable For Legal Reasons",
+	StatusCodeInternalServerError:           "Internal Server Error",
+	StatusCodeNotImplemented:                "Not Implemented",
+	StatusCodeBadGateway:                    "Bad Gateway",
+	StatusCodeServiceUnavailable:            "Service Unavailable",
+	StatusCodeGatewayTimeout:                "Gateway Timeout",
+	StatusCodeHTTPVersionNotSupported:       "HTTP Version Not Supported",
+	StatusCodeVariantAlsoNegotiates:         "Variant Also Negotiates",
+	StatusCodeInsufficientStorage:           "Insufficient Storage",
+	StatusCodeLoopDetected:                  "Loop Detected",
+	StatusCodeNotExtended:                   "Not Extended",
+	StatusCodeNetworkAuthenticationRequired: "Network Authentication Required",
+}
+
+// StatusText returns the reason phrase for statusCode, "" if it's unknown.
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
+// RFC 9110 15: a status code is three digits, and anything outside of
+// 100-599 isn't one.
+func validateStatusCode(statusCode StatusCode) error {
+	if statusCode < 100 || statusCode > 599 {
+		return fmt.Errorf("%w: %d", ErrInvalidStatusCode, statusCode)
+	}
+	return nil
+}
+
+// StatusLine is a status line with the parts a handler may want to pick
+// itself. An empty HttpVersion is the one the Writer answers with, an empty
+// ReasonPhrase is StatusText(Code).
+//
+//	HTTP/1.1 200 OK
+type StatusLine struct {
+	HttpVersion  string
+	Code         StatusCode
+	ReasonPhrase string
+}
+
+// Validate checks the code is in range and that the version and reason
+// phrase can't break out of the status line.
+// reason-phrase = 1*( HTAB / SP / VCHAR / obs-text )
+func (s StatusLine) Validate() error {
+	if err := validateStatusCode(s.Code); err != nil {
+		return err
+	}
+	if v := s.HttpVersion; v != "" && (len(v) != 3 || v[1] != '.' ||
+		v[0] < '0' || v[0] > '9' || v[2] < '0' || v[2] > '9') {
+		return fmt.Errorf("invalid HTTP version: %q", v)
+	}
+	for i := 0; i < len(s.ReasonPhrase); i++ {
+		if c := s.ReasonPhrase[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return fmt.Errorf("%w: byte %#x", ErrInvalidReasonPhrase, c)
+		}
+	}
+	return nil
+}
+
+func (s StatusLine) bytes() []byte {
+	reason := s.ReasonPhrase
+	if reason == "" {
+		reason = StatusText(s.Code)
+	}
+	return []byte(fmt.Sprintf("HTTP/%s %d %s%s", s.HttpVersion, s.Code, reason, crlf))
+}
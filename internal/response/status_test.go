@@ -0,0 +1,61 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusText(t *testing.T) {
+	assert.Equal(t, "OK", StatusText(StatusCodeSuccess))
+	assert.Equal(t, "Permanent Redirect", StatusText(StatusCodePermanentRedirect))
+	assert.Equal(t, "Too Many Requests", StatusText(StatusCodeTooManyRequests))
+	assert.Equal(t, "Network Authentication Required", StatusText(StatusCodeNetworkAuthenticationRequired))
+	assert.Equal(t, "", StatusText(299))
+
+	// Test: every registered code is a valid one
+	for code, text := range statusText {
+		assert.NoError(t, validateStatusCode(code))
+		assert.NotEmpty(t, text, code)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	for _, tc := range []struct {
+		line StatusLine
+		want string
+	}{
+		{StatusLine{Code: StatusCodeNotFound}, "HTTP/1.1 404 Not Found\r\n"},
+		{StatusLine{Code: StatusCodeSuccess, ReasonPhrase: "Fine Thanks"}, "HTTP/1.1 200 Fine Thanks\r\n"},
+		{StatusLine{Code: 299}, "HTTP/1.1 299 \r\n"},
+		{StatusLine{HttpVersion: "1.0", Code: StatusCodeGone}, "HTTP/1.0 410 Gone\r\n"},
+	} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		require.NoError(t, w.WriteStatus(tc.line))
+		require.NoError(t, w.Flush())
+		assert.Equal(t, tc.want, buf.String())
+		assert.Equal(t, tc.line.Code, w.StatusCode())
+	}
+
+	// Test: invalid status lines write nothing
+	for _, line := range []StatusLine{
+		{Code: 99},
+		{Code: 600},
+		{Code: 2000},
+		{Code: StatusCodeSuccess, ReasonPhrase: "OK\r\nSet-Cookie: a=1"},
+		{Code: StatusCodeSuccess, HttpVersion: "1.1 200 OK\r\n"},
+		{Code: StatusCodeContinue},
+	} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		assert.Error(t, w.WriteStatus(line), line)
+		assert.Empty(t, buf.String())
+		assert.Equal(t, WriteToStatusLine, w.WriterState)
+	}
+	assert.ErrorIs(t, StatusLine{Code: 42}.Validate(), ErrInvalidStatusCode)
+	assert.ErrorIs(t, StatusLine{Code: 200, ReasonPhrase: "\x00"}.Validate(), ErrInvalidReasonPhrase)
+	assert.ErrorIs(t, WriteStatusLine(&bytes.Buffer{}, 1000), ErrInvalidStatusCode)
+}
@@ -0,0 +1,55 @@
+package response
+
+import (
+	"httpfromtcp/internal/headers"
+	"strconv"
+)
+
+// Stream carries a response over something other than an HTTP/1
+// connection, an HTTP/2 stream say. The Writer keeps doing the bookkeeping
+// and hands the Stream the status, fields and body as they come, leaving
+// the framing to it.
+type Stream interface {
+	// WriteHeaders sends the status and header fields, it's called again
+	// for every 1xx before the final status.
+	WriteHeaders(statusCode StatusCode, h *headers.Headers) error
+	WriteData(p []byte) error
+	// WriteTrailers sends the trailer fields and ends the response.
+	WriteTrailers(h *headers.Headers) error
+	Flush() error
+	// Close ends the response once the handler is done, Abort cuts it off
+	// instead. Either may come after WriteTrailers.
+	Close() error
+	Abort() error
+}
+
+// NewStreamWriter returns a Writer for handlers to answer over s.
+func NewStreamWriter(s Stream) *Writer {
+	w := NewWriter(nil)
+	w.stream = s
+	return w
+}
+
+func (w *Writer) sendStreamHeaders(statusCode StatusCode, h *headers.Headers) error {
+	if err := validateFields(h); err != nil {
+		if statusCode >= 200 {
+			w.Abort()
+		}
+		return err
+	}
+	if val, ok := h.Get("Content-Length"); ok && statusCode >= 200 {
+		if n, err := strconv.Atoi(val); err == nil {
+			w.contentLength = n
+		}
+	}
+	return w.stream.WriteHeaders(statusCode, h)
+}
+
+func validateFields(h *headers.Headers) error {
+	for _, f := range h.Fields() {
+		if err := headers.ValidateField(f.Name, f.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
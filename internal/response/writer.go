@@ -1,9 +1,14 @@
 package response
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/headers"
 	"io"
+	"net"
+	"strconv"
 )
 
 type WriterState int
@@ -13,95 +18,577 @@ const (
 	WriteToHeaders
 	WriteToBody
 	WriteFinished
+	WriteHijacked // the connection was taken over, see Hijack
 )
 
 type Writer struct {
 	WriterState WriterState
-	writer      io.Writer
-}
+	// everything goes through the buffer, nothing reaches the connection
+	// until Flush, or Finish once the handler is done
+	writer *bufio.Writer
+	out    *sentWriter
+
+	// keepAlive is whether the connection can serve another request once
+	// this response is finished. It starts as whatever the server asked for
+	// and is dropped if the response can't be delimited without closing.
+	keepAlive       bool
+	version         string // HTTP version of the status line
+	head            bool   // answering a HEAD, the body is never sent
+	chunked         bool
+	contentLength   int // -1 when no Content-Length was sent
+	bodyWritten     int
+	trailersPending bool
+
+	statusCode   StatusCode
+	extraHeaders *headers.Headers
+	aborted      bool
+
+	// a 100 Continue is owed to the client, see ExpectContinue
+	continuePending bool
 
-type StatusLine struct {
-	HttpVersion  string
-	Code         StatusCode
-	ReasonPhrase string
+	// headers held back until the body's framing is known, and the body
+	// buffered meanwhile
+	pending *headers.Headers
+	body    bytes.Buffer
+
+	hijacker func() (net.Conn, []byte, error)
+	stream   Stream // set when the response goes out over something else than HTTP/1
 }
 
+// How much body is buffered to give it a Content-Length before giving up
+// and sending it chunked.
+const bodyBufferSize = 4 << 10
+
+// Size of the buffer between the Writer and the connection, a response
+// smaller than that goes out in one write.
+const outputBufferSize = 4 << 10
+
+var (
+	ErrBodyTooLong    = errors.New("body longer than its Content-Length")
+	ErrBodyNotAllowed = errors.New("response status doesn't allow a body")
+)
+
 func NewWriter(w io.Writer) *Writer {
+	out := &sentWriter{Writer: w}
 	return &Writer{
-		WriterState: WriteToStatusLine,
-		writer:      w,
+		WriterState:   WriteToStatusLine,
+		writer:        bufio.NewWriterSize(out, outputBufferSize),
+		out:           out,
+		version:       "1.1",
+		contentLength: -1,
+		extraHeaders:  headers.NewHeaders(),
 	}
 }
 
+// Sits between the buffer and the connection to tell whether any of the
+// final response went out yet.
+type sentWriter struct {
+	io.Writer
+	sent bool
+}
+
+func (s *sentWriter) Write(p []byte) (int, error) {
+	s.sent = s.sent || len(p) > 0
+	return s.Writer.Write(p)
+}
+
+// SetKeepAlive tells the writer whether the server wants to reuse the
+// connection after this response. It should be called before WriteHeaders,
+// turning it off later still closes the connection once the response is
+// done, the client just isn't told about it up front.
+func (w *Writer) SetKeepAlive(keepAlive bool) {
+	w.keepAlive = keepAlive
+}
+
+// SetVersion sets the HTTP version the response is for, "1.1" or "1.0".
+// HTTP/1.0 clients get a 1.0 status line, never get a chunked body, and
+// are told explicitly when the connection stays open.
+func (w *Writer) SetVersion(version string) {
+	w.version = version
+}
+
+// SetMethod sets the method of the request being answered. A response to
+// HEAD goes out with the headers a GET would get, Content-Length or
+// Transfer-Encoding included, but whatever the handler writes to the body
+// is dropped, chunk framing and trailers too.
+func (w *Writer) SetMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// KeepAlive reports whether the connection may be reused once the response
+// is finished.
+func (w *Writer) KeepAlive() bool {
+	return w.keepAlive
+}
+
+// Abort gives up on a response that can't be completed, e.g. the handler
+// panicked halfway through. Finish leaves it as is and the connection gets
+// closed, so the client sees a truncated response instead of a wrong one.
+func (w *Writer) Abort() {
+	w.aborted = true
+	w.keepAlive = false
+}
+
+// Reset throws away the response written so far so another one can take its
+// place, an error status once the handler turned out to have failed say.
+// That only works while none of it has reached the client, Reset reports
+// whether it did. Interim responses already sent don't count, and
+// keep-alive stays as it is.
+func (w *Writer) Reset() bool {
+	if w.WriterState == WriteHijacked {
+		return false
+	}
+	if w.WriterState != WriteToStatusLine && (w.stream != nil || w.out.sent) {
+		return false
+	}
+	w.writer.Reset(w.out)
+	w.WriterState = WriteToStatusLine
+	w.chunked = false
+	w.contentLength = -1
+	w.bodyWritten = 0
+	w.trailersPending = false
+	w.statusCode = 0
+	w.aborted = false
+	w.pending = nil
+	w.body.Reset()
+	return true
+}
+
+// Aborted reports whether Abort was called.
+func (w *Writer) Aborted() bool {
+	return w.aborted
+}
+
+// StatusCode returns the status sent with WriteStatusLine, 0 if it hasn't
+// been written yet.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns how many body bytes the handler has written so far,
+// buffered ones included, not counting chunked framing.
+func (w *Writer) BytesWritten() int {
+	return w.bodyWritten
+}
+
+// SetHeader adds a header to the ones the handler passes to WriteHeaders,
+// the handler's own value wins if it sets the same key. Lets middleware
+// add headers without knowing how the handler builds its response.
+func (w *Writer) SetHeader(key, value string) {
+	w.extraHeaders.Set(key, value)
+}
+
+// ExpectContinue tells the writer the client sent Expect: 100-continue and
+// won't send the body until it's told to. WriteContinue sends that go-ahead,
+// the server calls it when the handler first reads the body. A handler that
+// answers without reading it, say with a 417 or a 413, leaves the client
+// free to never send the body, so the connection gets closed after.
+func (w *Writer) ExpectContinue() {
+	w.continuePending = true
+}
+
+// WriteContinue sends the 100 Continue if the client is still waiting for
+// one. It does nothing once the final status line is out.
+func (w *Writer) WriteContinue() error {
+	if !w.continuePending || w.WriterState != WriteToStatusLine {
+		return nil
+	}
+	return w.WriteInformational(StatusCodeContinue, nil)
+}
+
+// WriteInformational sends an interim 1xx response, like 103 Early Hints
+// with Link headers, ahead of the final one. h may be nil. It can be called
+// any number of times before WriteStatusLine. 101 isn't allowed, switching
+// protocols takes over the connection. HTTP/1.0 clients don't understand
+// 1xx responses so nothing is sent to them.
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
+	if w.WriterState != WriteToStatusLine {
+		return fmt.Errorf("ReponseWriter not set to write to statusline > %v", w.WriterState)
+	}
+	if statusCode < 100 || statusCode > 199 || statusCode == 101 {
+		return fmt.Errorf("not an informational status code: %d", statusCode)
+	}
+	if w.version == "1.0" {
+		return nil
+	}
+	if statusCode == StatusCodeContinue {
+		w.continuePending = false
+	}
+	if h == nil {
+		h = headers.NewHeaders()
+	}
+	if w.stream != nil {
+		return w.sendStreamHeaders(statusCode, h)
+	}
+	var buf bytes.Buffer
+	buf.Write(getStatusLine(w.version, statusCode))
+	if err := WriteHeaders(&buf, h); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	// the client is waiting on it, or it'd be of no use
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	w.out.sent = false // nothing of the final response yet
+	return nil
+}
+
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatus(StatusLine{Code: statusCode})
+}
+
+// WriteStatus is WriteStatusLine with the chance to pick the reason phrase,
+// or the version. Nothing is written if the status line doesn't Validate.
+func (w *Writer) WriteStatus(line StatusLine) error {
 	if w.WriterState != WriteToStatusLine {
 		return fmt.Errorf("ReponseWriter not set to write to statusline > %v", w.WriterState)
 	}
+	if err := line.Validate(); err != nil {
+		return err
+	}
+	if line.Code < 200 {
+		return fmt.Errorf("use WriteInformational for %d", line.Code)
+	}
+	if line.HttpVersion == "" {
+		line.HttpVersion = w.version
+	}
+	if w.continuePending {
+		// the client may or may not send the body now, there's no telling
+		// where the next request would start
+		w.continuePending = false
+		w.keepAlive = false
+	}
 	defer func() { w.WriterState = WriteToHeaders }()
-	_, err := w.writer.Write(getStatusLine(statusCode))
+	w.statusCode = line.Code
+	if w.stream != nil {
+		return nil // it goes along with the headers
+	}
+	_, err := w.writer.Write(line.bytes())
 	return err
 }
 
-func (w *Writer) WriteHeaders(h headers.Headers) error {
+// WriteHeaders sends the headers, or holds on to them if they don't say how
+// the body is framed. In that case the body written next is buffered: if
+// the handler is done before it outgrows bodyBufferSize the response goes
+// out with a Content-Length, otherwise, or on Flush, it's sent chunked.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
 	if w.WriterState != WriteToHeaders {
 		return fmt.Errorf("ReponseWriter not set to write to Headers > %v", w.WriterState)
 	}
 	defer func() { w.WriterState = WriteToBody }()
+
+	for _, f := range w.extraHeaders.Fields() {
+		if _, ok := h.Get(f.Name); !ok {
+			h.Set(f.Name, f.Value)
+		}
+	}
+	_, hasLength := h.Get("Content-Length")
+	_, hasEncoding := h.Get("Transfer-Encoding")
+	if !hasLength && !hasEncoding && w.bodyAllowed() {
+		w.pending = h
+		return nil
+	}
+	return w.sendHeaders(h)
+}
+
+func (w *Writer) sendHeaders(h *headers.Headers) error {
+	if w.stream != nil {
+		return w.sendStreamHeaders(w.statusCode, h)
+	}
+	w.chunked = h.HasToken("Transfer-Encoding", "chunked")
+	if w.chunked && w.version == "1.0" {
+		// 1.0 doesn't know chunked, the body just runs until the close
+		h.Del("Transfer-Encoding")
+		h.Del("Trailer")
+		w.chunked = false
+	}
+	if val, ok := h.Get("Content-Length"); ok && !w.chunked {
+		if n, err := strconv.Atoi(val); err == nil {
+			w.contentLength = n
+		}
+	}
+	// Without a length or chunked framing the client can only find the end
+	// of the body by the connection closing.
+	if h.HasToken("Connection", "close") || (!w.chunked && w.contentLength < 0 && w.bodyAllowed() && !w.head) {
+		w.keepAlive = false
+	}
+	if !w.keepAlive {
+		h.Set("Connection", "close")
+	} else if w.version == "1.0" {
+		// 1.0 connections close by default, keeping one open is opt-in
+		h.Set("Connection", "keep-alive")
+	}
+
 	err := WriteHeaders(w.writer, h)
+	if errors.Is(err, headers.ErrInvalidFieldValue) || errors.Is(err, headers.ErrInvalidFieldName) {
+		w.replaceWithError()
+	}
 	return err
 }
 
-func (w *Writer) WriteBody(p []byte) (int, error) {
-	if w.WriterState != WriteToBody {
-		return 0, fmt.Errorf("ReponseWriter not ready to write to body > %v", w.WriterState)
+// Sends a plain 500 in place of a response whose headers can't be written.
+// If its status line already reached the client there's no valid way to go
+// on, and the response is aborted instead.
+func (w *Writer) replaceWithError() {
+	if !w.Reset() {
+		w.Abort()
+		return
 	}
-	defer func() { w.WriterState = WriteFinished }()
+	body := []byte(StatusText(StatusCodeInternalServerError))
+	w.statusCode = StatusCodeInternalServerError
+	w.writer.Write(getStatusLine(w.version, w.statusCode))
+	w.sendHeaders(GetDefaultHeaders(len(body)))
+	w.WriterState = WriteToBody
+	w.bodyWritten = len(body)
+	w.writeFramed(body)
+}
 
-	return w.writer.Write(p)
+// Sends the held back headers, framing the body by what's been buffered so
+// far: its length if it's complete, chunked if there's more to come.
+func (w *Writer) sendPending(complete bool) error {
+	h := w.pending
+	w.pending = nil
+	switch {
+	case complete && w.head && w.body.Len() == 0:
+		// the handler didn't bother with a body, there's no telling
+		// how long the GET one is
+	case complete:
+		h.Set("Content-Length", strconv.Itoa(w.body.Len()))
+	case w.stream == nil:
+		h.Set("Transfer-Encoding", "chunked")
+	}
+	if err := w.sendHeaders(h); err != nil {
+		return err
+	}
+	body := w.body.Bytes()
+	w.body.Reset()
+	return w.writeFramed(body)
+}
 
+// RFC 9110 6.4.1: no content with a 204 or a 304.
+func (w *Writer) bodyAllowed() bool {
+	return w.statusCode != StatusCodeNoContent && w.statusCode != StatusCodeNotModified
 }
 
-func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
-	if w.WriterState != WriteToBody {
-		return 0, fmt.Errorf("ResponseWriter not ready to write to body > %v", w.WriterState)
+// Write writes body bytes, so a Writer can be handed to anything that takes
+// an io.Writer. If the handler hasn't sent a status line and headers yet it
+// gets a 200 and text/plain, with the framing picked as WriteHeaders says.
+// It can be called any number of times.
+func (w *Writer) Write(p []byte) (int, error) {
+	switch w.WriterState {
+	case WriteToStatusLine:
+		if err := w.WriteStatusLine(StatusCodeSuccess); err != nil {
+			return 0, err
+		}
+		fallthrough
+	case WriteToHeaders:
+		h := headers.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		if err := w.WriteHeaders(h); err != nil {
+			return 0, err
+		}
+	case WriteFinished:
+		return 0, fmt.Errorf("ReponseWriter not ready to write to body > %v", w.WriterState)
+	case WriteHijacked:
+		return 0, ErrHijacked
+	}
+	if len(p) > 0 && !w.bodyAllowed() {
+		return 0, ErrBodyNotAllowed
 	}
+	if w.pending != nil {
+		w.body.Write(p)
+		w.bodyWritten += len(p)
+		if w.body.Len() > bodyBufferSize {
+			return len(p), w.sendPending(false)
+		}
+		return len(p), nil
+	}
+	if w.contentLength >= 0 && w.bodyWritten+len(p) > w.contentLength {
+		return 0, fmt.Errorf("%w: %d", ErrBodyTooLong, w.contentLength)
+	}
+	w.bodyWritten += len(p)
+	return len(p), w.writeFramed(p)
+}
 
-	chunkSize := len(p)
-	nTotal := 0
+// WriteBody is Write. It used to end the body, now it can be called again.
+func (w *Writer) WriteBody(p []byte) (int, error) {
+	return w.Write(p)
+}
 
-	n, err := fmt.Fprintf(w.writer, "%x\r\n", chunkSize)
-	if err != nil {
-		return nTotal, err
+// Writes body bytes once the headers are out, as a chunk if it's chunked.
+func (w *Writer) writeFramed(p []byte) error {
+	if len(p) == 0 {
+		return nil // an empty chunk would end the body
 	}
-	nTotal += n
-
-	n, err = w.writer.Write(p)
-	if err != nil {
-		return nTotal, err
+	if w.head {
+		return nil
+	}
+	if w.stream != nil {
+		return w.stream.WriteData(p)
 	}
-	nTotal += n
+	if !w.chunked {
+		_, err := w.writer.Write(p)
+		return err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%x\r\n", len(p))
+	buf.Write(p)
+	buf.WriteString(crlf)
+	_, err := w.writer.Write(buf.Bytes())
+	return err
+}
 
-	n, err = w.writer.Write([]byte("\r\n"))
-	if err != nil {
-		return nTotal, err
+// Flush sends everything written so far to the client, for streaming a
+// response out as it's produced. A body still waiting on its framing is
+// sent chunked from here on, there's no knowing its length anymore.
+func (w *Writer) Flush() error {
+	if w.WriterState == WriteHijacked {
+		return ErrHijacked
+	}
+	if w.pending != nil && !w.aborted {
+		if err := w.sendPending(false); err != nil {
+			return err
+		}
 	}
-	nTotal += n
+	if w.stream != nil {
+		return w.stream.Flush()
+	}
+	return w.writer.Flush()
+}
 
-	return nTotal, nil
+func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	if w.WriterState != WriteToBody {
+		return 0, fmt.Errorf("ResponseWriter not ready to write to body > %v", w.WriterState)
+	}
+	if w.pending != nil {
+		if err := w.sendPending(false); err != nil {
+			return 0, err
+		}
+	}
+	if !w.chunked {
+		return w.Write(p)
+	}
+	w.bodyWritten += len(p)
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return len(p) + len(fmt.Sprintf("%x", len(p))) + 2*len(crlf), w.writeFramed(p)
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	if w.WriterState != WriteToBody {
 		return 0, fmt.Errorf("ResponseWriter not ready to write to body > %v", w.WriterState)
 	}
+	if w.pending != nil {
+		// nothing went out yet, so the length is known after all
+		if err := w.sendPending(true); err != nil {
+			return 0, err
+		}
+	}
 	defer func() { w.WriterState = WriteFinished }()
+	if w.head {
+		return 0, nil // no last chunk and nowhere for trailers
+	}
+	if w.stream != nil {
+		w.trailersPending = true // streams can always carry trailers
+		return 0, nil
+	}
+	if !w.chunked {
+		return 0, nil
+	}
+	w.trailersPending = true
 	chunkedEnd := []byte("0\r\n")
 	return w.writer.Write(chunkedEnd)
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	if w.WriterState != WriteFinished {
 		return fmt.Errorf("ResponseWriter not ready to write trailers > %v", w.WriterState)
 	}
-	return WriteHeaders(w.writer, h)
+	if !w.trailersPending {
+		return nil // nowhere to put them without chunked framing
+	}
+	if w.stream != nil {
+		if err := validateFields(h); err != nil {
+			return err
+		}
+		w.trailersPending = false
+		return w.stream.WriteTrailers(h)
+	}
+	// on an invalid field nothing is written and Finish still ends the body
+	if err := WriteHeaders(w.writer, h); err != nil {
+		return err
+	}
+	w.trailersPending = false
+	return nil
+}
+
+// Finish is called by the server once the handler returns so the response on
+// the wire is complete before the next one starts.
+// A handler that wrote nothing gets an empty 200, a buffered body goes out
+// with its Content-Length, a chunked body is terminated if the handler left
+// it open, and a body that doesn't match its Content-Length turns
+// keep-alive off. Then it's all flushed.
+func (w *Writer) Finish() error {
+	if w.WriterState == WriteHijacked {
+		return nil // the connection isn't ours anymore
+	}
+	err := w.finish()
+	if w.stream != nil {
+		if err != nil {
+			return err
+		}
+		// a body short of its Content-Length can't just end, the
+		// stream is cut off instead
+		short := w.contentLength >= 0 && w.bodyWritten < w.contentLength && w.bodyAllowed() && !w.head
+		if w.aborted || short {
+			return w.stream.Abort()
+		}
+		return w.stream.Close()
+	}
+	// flushed even after an error, held back headers that turn out to be
+	// invalid only now leave the 500 that replaced them in the buffer
+	if flushErr := w.writer.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func (w *Writer) finish() error {
+	if w.aborted {
+		return nil
+	}
+	switch w.WriterState {
+	case WriteToStatusLine:
+		if err := w.WriteStatusLine(StatusCodeSuccess); err != nil {
+			return err
+		}
+		fallthrough
+	case WriteToHeaders:
+		if err := w.WriteHeaders(GetDefaultHeaders(0)); err != nil {
+			return err
+		}
+		w.WriterState = WriteFinished
+	case WriteToBody:
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		return w.finish()
+	case WriteFinished:
+		if w.trailersPending {
+			w.trailersPending = false
+			if w.stream != nil {
+				return nil // closing the stream ends it
+			}
+			_, err := w.writer.Write([]byte(crlf))
+			return err
+		}
+		if !w.chunked && w.contentLength >= 0 && w.bodyWritten != w.contentLength && !w.head {
+			w.keepAlive = false
+		}
+	}
+	return nil
 }
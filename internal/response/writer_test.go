@@ -0,0 +1,224 @@
+package response
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWriter(version string) (*Writer, *bytes.Buffer) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetVersion(version)
+	w.SetKeepAlive(true)
+	return w, &buf
+}
+
+func TestWriterContentLength(t *testing.T) {
+	// Test: several writes, the length is worked out at the end
+	w, buf := newTestWriter("1.1")
+	var _ io.Writer = w
+	fmt.Fprintf(w, "hello %s", "there")
+	io.Copy(w, strings.NewReader(", world"))
+	assert.Equal(t, 18, w.BytesWritten())
+	assert.Empty(t, buf.String(), "nothing goes out until the length is known")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 18\r\n\r\nhello there, world", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: the handler's own status and headers are kept
+	w, buf = newTestWriter("1.1")
+	w.WriteStatusLine(StatusCodeCreated)
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "application/json")
+	w.WriteHeaders(h)
+	w.WriteBody([]byte(`{"a":`))
+	w.WriteBody([]byte(`1}`))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 201 Created\r\nContent-Type: application/json\r\nContent-Length: 7\r\n\r\n{\"a\":1}", buf.String())
+
+	// Test: an explicit Content-Length is written through and enforced
+	w, buf = newTestWriter("1.1")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(GetDefaultHeaders(4))
+	w.Write([]byte("ab"))
+	w.Flush()
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nab"))
+	_, err := w.Write([]byte("cde"))
+	assert.ErrorIs(t, err, ErrBodyTooLong)
+	w.Write([]byte("cd"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nabcd"))
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterChunked(t *testing.T) {
+	big := strings.Repeat("x", bodyBufferSize+1)
+
+	// Test: past the buffer the body goes out chunked
+	w, buf := newTestWriter("1.1")
+	w.Write([]byte(big))
+	w.Write([]byte("tail"))
+	require.NoError(t, w.Finish())
+	want := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		fmt.Sprintf("%x\r\n%s\r\n", len(big), big) + "4\r\ntail\r\n0\r\n\r\n"
+	assert.Equal(t, want, buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Flush gives up on the length
+	w, buf = newTestWriter("1.1")
+	w.Write([]byte("first"))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n", buf.String())
+	w.Write([]byte("second"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "6\r\nsecond\r\n0\r\n\r\n"))
+
+	// Test: HTTP/1.0 gets the body until the connection closes instead
+	w, buf = newTestWriter("1.0")
+	w.Write([]byte(big))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n"+big, buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: WriteChunkedBody without a Transfer-Encoding still chunks
+	w, buf = newTestWriter("1.1")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(headers.NewHeaders())
+	w.WriteChunkedBody([]byte("abc"))
+	w.WriteChunkedBody(nil)
+	w.WriteChunkedBodyDone()
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", buf.String())
+}
+
+func TestWriterNoBody(t *testing.T) {
+	for _, code := range []StatusCode{StatusCodeNoContent, StatusCodeNotModified} {
+		w, buf := newTestWriter("1.1")
+		w.WriteStatusLine(code)
+		w.WriteHeaders(headers.NewHeaders())
+		_, err := w.Write([]byte("x"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+		require.NoError(t, w.Finish())
+		assert.Equal(t, fmt.Sprintf("HTTP/1.1 %d %s\r\n\r\n", code, StatusText(code)), buf.String())
+		assert.True(t, w.KeepAlive())
+	}
+}
+
+func TestWriterHead(t *testing.T) {
+	// Test: a buffered body is measured for its Content-Length, not sent
+	w, buf := newTestWriter("1.1")
+	w.SetMethod("HEAD")
+	w.Write([]byte("hello"))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: the handler's Content-Length goes out even with no body
+	w, buf = newTestWriter("1.1")
+	w.SetMethod("HEAD")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(GetDefaultHeaders(10))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: chunked, but no chunks, last chunk or trailers
+	w, buf = newTestWriter("1.1")
+	w.SetMethod("HEAD")
+	w.Write([]byte("first"))
+	w.Flush()
+	w.WriteChunkedBodyDone()
+	tr := headers.NewHeaders()
+	tr.Set("X-Sum", "1")
+	require.NoError(t, w.WriteTrailers(tr))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterBuffered(t *testing.T) {
+	// Test: a framed body is held in the buffer until Flush
+	w, buf := newTestWriter("1.1")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(GetDefaultHeaders(10))
+	w.Write([]byte("hello"))
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.Flush())
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\nhello"))
+
+	// Test: and the rest goes out on Finish
+	w.Write([]byte("world"))
+	assert.True(t, strings.HasSuffix(buf.String(), "hello"))
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasSuffix(buf.String(), "helloworld"))
+
+	// Test: output past the buffer size reaches the connection on its own
+	w, buf = newTestWriter("1.1")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(GetDefaultHeaders(outputBufferSize * 2))
+	w.Write([]byte(strings.Repeat("x", outputBufferSize*2)))
+	assert.NotEmpty(t, buf.String())
+}
+
+func TestWriterReset(t *testing.T) {
+	// Test: a response still in the buffer is thrown away, interim ones
+	// already sent stay
+	w, buf := newTestWriter("1.1")
+	w.WriteInformational(StatusCodeEarlyHints, nil)
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(GetDefaultHeaders(5))
+	w.Write([]byte("hello"))
+	require.True(t, w.Reset())
+	w.WriteStatusLine(StatusCodeInternalServerError)
+	w.WriteHeaders(GetDefaultHeaders(0))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n\r\n"+
+		"HTTP/1.1 500 Internal Server Error\r\nContent-Length: 0\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+
+	// Test: not once some of it reached the client
+	w, buf = newTestWriter("1.1")
+	w.WriteStatusLine(StatusCodeSuccess)
+	w.WriteHeaders(GetDefaultHeaders(5))
+	w.Flush()
+	sent := buf.String()
+	assert.False(t, w.Reset())
+	assert.Equal(t, WriteToBody, w.WriterState)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, sent, buf.String())
+}
+
+func TestWriterHijack(t *testing.T) {
+	// Test: nothing to hand over without a hijacker
+	w, _ := newTestWriter("1.1")
+	_, _, err := w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+
+	// Test: output so far is flushed and the Writer is done with
+	w, buf := newTestWriter("1.1")
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	w.SetHijacker(func() (net.Conn, []byte, error) { return server, []byte("next"), nil })
+	w.WriteInformational(StatusCodeEarlyHints, nil)
+	conn, buffered, err := w.Hijack()
+	require.NoError(t, err)
+	assert.Equal(t, server, conn)
+	assert.Equal(t, "next", string(buffered))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n\r\n", buf.String())
+	assert.True(t, w.Hijacked())
+	assert.False(t, w.KeepAlive())
+	_, err = w.Write([]byte("x"))
+	assert.ErrorIs(t, err, ErrHijacked)
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrHijacked)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\r\n\r\n", buf.String())
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"httpfromtcp/internal/request"
+	"time"
+)
+
+// DefaultIdleTimeout is used when Config.IdleTimeout is left at zero.
+const DefaultIdleTimeout = 60 * time.Second
+
+// DefaultReadHeaderTimeout is used when Config.ReadHeaderTimeout is left at
+// zero, so a client trickling in a request line can't hold a connection open.
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// DefaultNewConnGracePeriod is used when Config.NewConnGracePeriod is left
+// at zero.
+const DefaultNewConnGracePeriod = 5 * time.Second
+
+// DefaultMaxPipelinedBodyBytes caps request bodies while pipelining when
+// Limits.MaxBodyBytes is left at zero. Pipelined bodies are read into memory
+// before their handler runs, so they can't go without a limit.
+const DefaultMaxPipelinedBodyBytes = 1 << 20
+
+// Config holds the knobs for how connections are served.
+// The zero value is usable.
+type Config struct {
+	// ReadHeaderTimeout is how long a request has from its first byte to the
+	// end of its headers. Running out gets a 408 Request Timeout.
+	// Zero means DefaultReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout is how long a request has from its first byte to the end of
+	// its body, the handler sees a timeout error reading past it.
+	// Zero means no limit.
+	ReadTimeout time.Duration
+	// WriteTimeout is how long the response has to be written once the
+	// request headers are in. Zero means no limit.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a connection may wait for its next request
+	// before it's closed. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// NewConnGracePeriod is how long Shutdown lets a connection that hasn't
+	// sent anything yet start on its first request before closing it as
+	// idle. Zero means DefaultNewConnGracePeriod.
+	NewConnGracePeriod time.Duration
+	// MaxRequestsPerConn caps how many requests are served on a single
+	// connection, the last response carries Connection: close.
+	// Zero means no limit.
+	MaxRequestsPerConn int
+	// MaxPipelinedRequests turns on concurrent handling of pipelined
+	// requests: up to this many requests read off one connection are handled
+	// at the same time, their responses buffered and written back in request
+	// order. Zero or one handles requests one at a time. Connections can't
+	// be hijacked while pipelining, and bodies are capped at
+	// DefaultMaxPipelinedBodyBytes unless Limits.MaxBodyBytes is set.
+	MaxPipelinedRequests int
+	// Limits caps the size of incoming requests, zero size fields use
+	// request.DefaultLimits. Limits.Strict refuses bare LF and obs-fold.
+	Limits request.Limits
+	// H2C turns on HTTP/2 over cleartext, for clients that start with the
+	// HTTP/2 preface and for requests asking to Upgrade: h2c. Streams are
+	// handled concurrently, IdleTimeout and Limits apply to them but the
+	// read and write timeouts don't. Upgrades aren't taken while
+	// pipelining.
+	H2C bool
+}
+
+// The limits requests on a connection are read with. Pipelined bodies are
+// buffered whole, so they always get a cap.
+func (c Config) limits() request.Limits {
+	l := c.Limits
+	if c.MaxPipelinedRequests > 1 && l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = DefaultMaxPipelinedBodyBytes
+	}
+	return l
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c Config) newConnGracePeriod() time.Duration {
+	if c.NewConnGracePeriod <= 0 {
+		return DefaultNewConnGracePeriod
+	}
+	return c.NewConnGracePeriod
+}
+
+// Deadline for the request line and headers of a request that started at start.
+// Never later than the ReadTimeout deadline.
+func (c Config) headerDeadline(start time.Time) time.Time {
+	timeout := c.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultReadHeaderTimeout
+	}
+	if c.ReadTimeout > 0 && c.ReadTimeout < timeout {
+		timeout = c.ReadTimeout
+	}
+	return start.Add(timeout)
+}
+
+// Deadline for reading the body of a request that started at start, the zero
+// time if there isn't one.
+func (c Config) readDeadline(start time.Time) time.Time {
+	if c.ReadTimeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(c.ReadTimeout)
+}
+
+// Deadline for writing a response started at start, the zero time if there
+// isn't one.
+func (c Config) writeDeadline(start time.Time) time.Time {
+	if c.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(c.WriteTimeout)
+}
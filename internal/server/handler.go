@@ -17,7 +17,7 @@ type Handler func(w *response.Writer, req *request.Request)
 // type Handler func(w io.Writer, req *request.Request) *HandlerError
 
 func (h *HandlerError) GetStatusLine() []byte {
-	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", h.StatusCode, ""))
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n", h.StatusCode, response.StatusText(h.StatusCode)))
 
 }
 
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a Handler to run code around it.
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler in middlewares. The first one is the outermost, so it
+// sees the request first and the finished response last.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Logger logs one line per request once it's been handled: method, target,
+// status, body bytes and how long it took. A nil logger uses log's default.
+func Logger(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			logger.Printf("%s %s %d %dB %v",
+				req.RequestLine.Method,
+				req.RequestLine.RequestTarget,
+				w.StatusCode(),
+				w.BytesWritten(),
+				time.Since(start))
+		}
+	}
+}
+
+// Recoverer turns a panicking handler into a 500 when nothing has been
+// written yet. Once the response has started there's no way to take it back,
+// so it's aborted and the connection closed after whatever made it out.
+// The server does the same for panics that get past the middleware, this
+// just catches them closer to the handler.
+func Recoverer(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				log.Printf("Server::Recoverer::panic > %v\n%s", rec, debug.Stack())
+				writePanicResponse(w)
+			}
+		}()
+		next(w, req)
+	}
+}
+
+// RequestIDHeader carries the id set by RequestID.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID makes sure every request has an X-Request-ID, keeping the one
+// the client sent if it looks sane, and echoes it in the response.
+func RequestID(next Handler) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		id, ok := req.Headers.Get(RequestIDHeader)
+		if !ok || !validRequestID(id) {
+			id = newRequestID()
+			req.Headers.Set(RequestIDHeader, id)
+		}
+		w.SetHeader(RequestIDHeader, id)
+		next(w, req)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Client ids get echoed back, so only plain, short ones are trusted.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handleResult runs rawRequest through handler and returns the writer and the response.
+func handleResult(t *testing.T, handler Handler, rawRequest string) (*response.Writer, testResponse) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	w.SetKeepAlive(true)
+	handler(w, req)
+	require.NoError(t, w.Finish())
+	return w, readResponse(t, bufio.NewReader(buf))
+}
+
+func TestChainOrder(t *testing.T) {
+	calls := []string{}
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name+" in")
+				next(w, req)
+				calls = append(calls, name+" out")
+			}
+		}
+	}
+	handler := Chain(okHandler, trace("a"), trace("b"))
+	handleResult(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, []string{"a in", "b in", "b out", "a out"}, calls)
+}
+
+func TestLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	handler := Chain(okHandler, Logger(log.New(out, "", 0)))
+	handleResult(t, handler, "GET /logged?x=1 HTTP/1.1\r\n\r\n")
+	assert.True(t, strings.HasPrefix(out.String(), "GET /logged?x=1 200 19B "), out.String())
+}
+
+func TestRecoverer(t *testing.T) {
+	logOutput := log.Writer()
+	log.SetOutput(&bytes.Buffer{})
+	defer log.SetOutput(logOutput)
+
+	// Test: Panic before anything is written becomes a 500
+	panics := func(w *response.Writer, req *request.Request) { panic("boom") }
+	w, resp := handleResult(t, Chain(panics, Recoverer), "GET / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error", resp.statusLine)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Panic after the status line aborts the response
+	late := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		panic("boom")
+	}
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w = response.NewWriter(buf)
+	w.SetKeepAlive(true)
+	Chain(late, Recoverer)(w, req)
+	require.NoError(t, w.Finish())
+	assert.True(t, w.Aborted())
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := Chain(func(w *response.Writer, req *request.Request) {
+		seen, _ = req.Headers.Get(RequestIDHeader)
+		okHandler(w, req)
+	}, RequestID)
+
+	// Test: Generated when missing
+	_, resp := handleResult(t, handler, "GET / HTTP/1.1\r\n\r\n")
+	assert.Len(t, seen, 16)
+	assert.Equal(t, seen, resp.headers["x-request-id"])
+
+	// Test: Client's id is kept
+	_, resp = handleResult(t, handler, "GET / HTTP/1.1\r\nX-Request-ID: abc-123\r\n\r\n")
+	assert.Equal(t, "abc-123", seen)
+	assert.Equal(t, "abc-123", resp.headers["x-request-id"])
+
+	// Test: Junk ids are replaced
+	_, resp = handleResult(t, handler, "GET / HTTP/1.1\r\nX-Request-ID: <script>\r\n\r\n")
+	assert.NotEqual(t, "<script>", resp.headers["x-request-id"])
+	assert.Len(t, resp.headers["x-request-id"], 16)
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// A response to a pipelined request, buffered until it's its turn to be
+// written to the connection.
+type pipelinedResponse struct {
+	buf  bytes.Buffer
+	w    *response.Writer
+	done chan struct{}
+	// holds one of the pipeline's handler slots until the writer gets to it
+	slot bool
+}
+
+func newPipelinedResponse() *pipelinedResponse {
+	resp := &pipelinedResponse{done: make(chan struct{})}
+	resp.w = response.NewWriter(&resp.buf)
+	return resp
+}
+
+// An interim 100 Continue, written in order like any other response.
+func continueResponse(req *request.Request) *pipelinedResponse {
+	resp := newPipelinedResponse()
+	resp.w.SetVersion(req.RequestLine.HttpVersion)
+	resp.w.SetKeepAlive(true)
+	resp.w.ExpectContinue()
+	resp.w.WriteContinue()
+	close(resp.done)
+	return resp
+}
+
+// State shared by the reading and writing halves of a pipelined connection.
+// Both move the read deadline around, mu keeps them from undoing each other.
+type pipeline struct {
+	conn  *trackedConn
+	queue chan *pipelinedResponse
+	// one per handler started and not yet picked up by the writer, so no
+	// more than MaxPipelinedRequests run at once
+	slots chan struct{}
+
+	mu sync.Mutex
+	// requests read but whose response hasn't been written yet
+	inFlight int
+	// the reader is waiting for the next request to start
+	waiting bool
+	// set by the writer once a response ended the connection
+	stopped bool
+}
+
+// Sets the read deadline unless the writer has already stopped the reader.
+// Reports whether the reader should keep going.
+func (p *pipeline) setReadDeadline(t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	p.conn.SetReadDeadline(t)
+	return true
+}
+
+// Unblocks the reader by expiring its deadline, it won't read anything else.
+func (p *pipeline) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	p.conn.SetReadDeadline(time.Now())
+}
+
+func (p *pipeline) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+func (p *pipeline) enqueue(resp *pipelinedResponse) {
+	p.mu.Lock()
+	p.inFlight++
+	p.mu.Unlock()
+	p.queue <- resp
+}
+
+// Reads requests off the connection and runs their handlers concurrently,
+// up to MaxPipelinedRequests at a time. Responses are written back strictly
+// in the order the requests arrived, a slow handler holds back the ones
+// behind it. Request bodies are buffered before the handler runs since the
+// next request can't be read until the body is off the connection, which is
+// why they're always capped, see Config.limits.
+//
+// The idle timeout only runs while no responses are outstanding, a client
+// waiting on a slow handler isn't idle.
+func (s *Server) servePipelined(conn *trackedConn, reader *request.Reader) {
+	p := &pipeline{
+		conn:  conn,
+		queue: make(chan *pipelinedResponse, s.config.MaxPipelinedRequests),
+		slots: make(chan struct{}, s.config.MaxPipelinedRequests),
+	}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		s.writePipelined(p)
+	}()
+
+	for served := 0; ; served++ {
+		p.mu.Lock()
+		p.waiting = true
+		deadline := time.Time{}
+		if p.inFlight == 0 {
+			deadline = time.Now().Add(s.config.idleTimeout())
+		}
+		p.mu.Unlock()
+		if !p.setReadDeadline(deadline) {
+			break
+		}
+		err := reader.WaitForData()
+		p.mu.Lock()
+		p.waiting = false
+		p.mu.Unlock()
+		if err != nil {
+			break
+		}
+
+		start := time.Now()
+		if !p.setReadDeadline(s.config.headerDeadline(start)) {
+			break
+		}
+		req, err := reader.ReadRequest()
+		if err == nil {
+			if !p.setReadDeadline(s.config.readDeadline(start)) {
+				break
+			}
+			if req.ExpectsContinue() {
+				// the body is needed before the handler runs, so there's
+				// no turning it down, the 100 goes out in its turn
+				p.enqueue(continueResponse(req))
+			}
+			_, err = req.ReadBody()
+			req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
+		}
+		if err != nil {
+			if p.isStopped() {
+				break
+			}
+			resp := newPipelinedResponse()
+			if isTimeout(err) {
+				writeRequestTimeout(resp.w)
+			} else if isConnDone(err) {
+				break
+			} else {
+				writeParseError(resp.w, err)
+			}
+			close(resp.done)
+			p.enqueue(resp)
+			break
+		}
+
+		resp := newPipelinedResponse()
+		keepAlive := s.keepAlive(req, served+1)
+		resp.w.SetVersion(req.RequestLine.HttpVersion)
+		resp.w.SetMethod(req.RequestLine.Method)
+		resp.w.SetKeepAlive(keepAlive)
+		p.slots <- struct{}{}
+		resp.slot = true
+		go func() {
+			defer close(resp.done)
+			s.runHandler(resp.w, req)
+			if resp.w.Aborted() {
+				// nothing has reached the client yet, so a broken
+				// response can still be swapped for a clean 500
+				resp.buf.Reset()
+				resp.w = response.NewWriter(&resp.buf)
+				resp.w.SetVersion(req.RequestLine.HttpVersion)
+				resp.w.SetMethod(req.RequestLine.Method)
+				writePanicResponse(resp.w)
+			}
+			if err := resp.w.Finish(); err != nil {
+				log.Printf("Server::servePipelined::error > %v", err)
+			}
+		}()
+		p.enqueue(resp)
+		if !keepAlive {
+			break
+		}
+	}
+	close(p.queue)
+	<-writerDone
+}
+
+// Writes queued responses in order. Once a response ends the connection it
+// stops the reader and drains the rest of the queue.
+func (s *Server) writePipelined(p *pipeline) {
+	for resp := range p.queue {
+		<-resp.done
+		if resp.slot {
+			<-p.slots
+		}
+		if p.isStopped() {
+			continue
+		}
+		p.conn.SetWriteDeadline(s.config.writeDeadline(time.Now()))
+		if _, err := p.conn.Write(resp.buf.Bytes()); err != nil || !resp.w.KeepAlive() {
+			p.stop()
+			continue
+		}
+
+		p.mu.Lock()
+		p.inFlight--
+		idle := p.inFlight == 0 && p.waiting
+		if idle {
+			// the client now has IdleTimeout to send more
+			p.conn.setIdle()
+			p.conn.SetReadDeadline(time.Now().Add(s.config.idleTimeout()))
+		}
+		p.mu.Unlock()
+		if idle && s.closed.Load() {
+			p.stop()
+		}
+	}
+}
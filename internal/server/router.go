@@ -0,0 +1,229 @@
+package server
+
+import (
+	"fmt"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"sort"
+	"strings"
+)
+
+// Router dispatches requests to handlers by method and path.
+//
+// Patterns look like "GET /users/{id}" or "/static/{path...}":
+//   - the method is optional, without one the route answers any method
+//   - {name} matches a single path segment
+//   - {name...} at the end matches the rest of the path, even if empty
+//
+// Literal segments win over {name}, which wins over {name...}, no matter the
+// order routes were added in. Paths are matched segment by segment as sent,
+// so "%2F" doesn't count as a '/'. Captured segments are percent-decoded and
+// end up in Request.Params.
+// Paths with no route get a 404, paths that only have routes for other
+// methods get a 405 with an Allow header.
+type Router struct {
+	root *routeNode
+}
+
+// One segment of the route tree. A node with handlers is the end of a route.
+type routeNode struct {
+	literals map[string]*routeNode
+	param    *routeNode
+	wildcard *routeNode
+	name     string             // parameter name for param and wildcard nodes
+	handlers map[string]Handler // by method, "" is any method
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{
+		literals: map[string]*routeNode{},
+		handlers: map[string]Handler{},
+	}
+}
+
+func NewRouter() *Router {
+	return &Router{root: newRouteNode()}
+}
+
+// Registers handler for pattern. Panics on a malformed pattern or one that's
+// already registered, both are programming errors caught at startup.
+func (rt *Router) Handle(pattern string, handler Handler) {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	path = strings.TrimLeft(path, " ")
+	if !strings.HasPrefix(path, "/") {
+		panic(fmt.Sprintf("router: pattern path must start with '/': %q", pattern))
+	}
+
+	node := rt.root
+	segments := splitPath(path)
+	for i, segment := range segments {
+		isParam := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if !isParam {
+			if strings.ContainsAny(segment, "{}") {
+				panic(fmt.Sprintf("router: bad segment %q in pattern %q", segment, pattern))
+			}
+			if node.literals[segment] == nil {
+				node.literals[segment] = newRouteNode()
+			}
+			node = node.literals[segment]
+			continue
+		}
+
+		name := segment[1 : len(segment)-1]
+		if tail, ok := strings.CutSuffix(name, "..."); ok {
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: {%s} must be the last segment in %q", name, pattern))
+			}
+			node.wildcard = rt.paramNode(node.wildcard, tail, pattern)
+			node = node.wildcard
+			continue
+		}
+		node.param = rt.paramNode(node.param, name, pattern)
+		node = node.param
+	}
+
+	if _, exists := node.handlers[method]; exists {
+		panic(fmt.Sprintf("router: pattern %q is already registered", pattern))
+	}
+	node.handlers[method] = handler
+}
+
+// Returns the param or wildcard node to descend into, making it if needed.
+// All routes through the same position have to agree on the name.
+func (rt *Router) paramNode(node *routeNode, name, pattern string) *routeNode {
+	if name == "" {
+		panic(fmt.Sprintf("router: unnamed parameter in pattern %q", pattern))
+	}
+	if node == nil {
+		node = newRouteNode()
+		node.name = name
+	}
+	if node.name != name {
+		panic(fmt.Sprintf("router: parameter {%s} in %q conflicts with {%s}", name, pattern, node.name))
+	}
+	return node
+}
+
+// ServeHTTP is the Router's Handler, pass it to Serve.
+func (rt *Router) ServeHTTP(w *response.Writer, req *request.Request) {
+	// match on the path as sent, so an escaped '/' (%2F) stays inside its
+	// segment instead of splitting it in two
+	matches := rt.root.match(splitPath(req.Target.RawPath), map[string]string{}, nil)
+	if len(matches) == 0 {
+		writeRouterError(w, response.StatusCodeNotFound, nil)
+		return
+	}
+
+	method := req.RequestLine.Method
+	for _, m := range matches {
+		handler, ok := m.node.handlers[method]
+		if !ok && method == "HEAD" {
+			handler, ok = m.node.handlers["GET"]
+		}
+		if !ok {
+			handler, ok = m.node.handlers[""]
+		}
+		if ok {
+			req.Params = m.params
+			handler(w, req)
+			return
+		}
+	}
+
+	allowed := map[string]bool{}
+	for _, m := range matches {
+		for method := range m.node.handlers {
+			allowed[method] = true
+		}
+	}
+	if allowed["GET"] {
+		allowed["HEAD"] = true
+	}
+	writeRouterError(w, response.StatusCodeMethodNotAllowed, allowed)
+}
+
+type routeMatch struct {
+	node   *routeNode
+	params map[string]string
+}
+
+// Collects every route matching segments, most specific first. segments are
+// still escaped, each one is decoded before it's compared or captured.
+func (n *routeNode) match(segments []string, params map[string]string, matches []routeMatch) []routeMatch {
+	if len(segments) == 0 {
+		if len(n.handlers) > 0 {
+			matches = append(matches, routeMatch{node: n, params: copyParams(params)})
+		}
+		// {name...} also matches an empty tail
+		if n.wildcard != nil && len(n.wildcard.handlers) > 0 {
+			matches = append(matches, routeMatch{node: n.wildcard, params: withParam(params, n.wildcard.name, "")})
+		}
+		return matches
+	}
+
+	segment, rest := unescapeSegment(segments[0]), segments[1:]
+	if next, ok := n.literals[segment]; ok {
+		matches = next.match(rest, params, matches)
+	}
+	if n.param != nil && segment != "" {
+		matches = n.param.match(rest, withParam(params, n.param.name, segment), matches)
+	}
+	if n.wildcard != nil && len(n.wildcard.handlers) > 0 {
+		tail := unescapeSegment(strings.Join(segments, "/"))
+		matches = append(matches, routeMatch{node: n.wildcard, params: withParam(params, n.wildcard.name, tail)})
+	}
+	return matches
+}
+
+func copyParams(params map[string]string) map[string]string {
+	out := make(map[string]string, len(params))
+	for k, v := range params {
+		out[k] = v
+	}
+	return out
+}
+
+func withParam(params map[string]string, name, value string) map[string]string {
+	out := copyParams(params)
+	out[name] = value
+	return out
+}
+
+// The request parser already checked the escapes in the whole path, so this
+// can't fail on a piece of it.
+func unescapeSegment(segment string) string {
+	decoded, err := request.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return decoded
+}
+
+// "/users/42" -> ["users", "42"], "/" -> [""]
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+func writeRouterError(w *response.Writer, statusCode response.StatusCode, allowed map[string]bool) {
+	body := []byte("404 page not found\n")
+	if statusCode == response.StatusCodeMethodNotAllowed {
+		body = []byte("405 method not allowed\n")
+	}
+	h := response.GetDefaultHeaders(len(body))
+	if allowed != nil {
+		methods := []string{}
+		for method := range allowed {
+			if method != "" {
+				methods = append(methods, method)
+			}
+		}
+		sort.Strings(methods)
+		h.Set("Allow", strings.Join(methods, ", "))
+	}
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// routeResult runs rawRequest through the router and reads back the response.
+func routeResult(t *testing.T, router *Router, rawRequest string) testResponse {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(rawRequest))
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	w := response.NewWriter(buf)
+	router.ServeHTTP(w, req)
+	require.NoError(t, w.Finish())
+	return readResponse(t, bufio.NewReader(buf))
+}
+
+// named returns a handler that answers with its name and the captured params.
+func named(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := []byte(name)
+		for _, key := range []string{"id", "path", "name"} {
+			if val, ok := req.Params[key]; ok {
+				body = append(body, []byte(" "+key+"="+val)...)
+			}
+		}
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	router.Handle("GET /users/{id}", named("getUser"))
+	router.Handle("DELETE /users/{id}", named("deleteUser"))
+	router.Handle("GET /users/new", named("newUser"))
+	router.Handle("POST /users", named("createUser"))
+	router.Handle("/static/{path...}", named("static"))
+	router.Handle("GET /", named("index"))
+
+	// Test: Params are captured
+	resp := routeResult(t, router, "GET /users/42 HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "getUser id=42", resp.body)
+
+	// Test: Literal segment wins over a parameter
+	resp = routeResult(t, router, "GET /users/new HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "newUser", resp.body)
+
+	// Test: Falls back to the parameter route for other methods
+	resp = routeResult(t, router, "DELETE /users/new HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "deleteUser id=new", resp.body)
+
+	// Test: Query string doesn't affect matching
+	resp = routeResult(t, router, "GET /users/7?verbose=1 HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "getUser id=7", resp.body)
+
+	// Test: An escaped '/' doesn't split a segment, captures are decoded
+	resp = routeResult(t, router, "GET /users/a%2Fb HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "getUser id=a/b", resp.body)
+	resp = routeResult(t, router, "GET /users/%6Eew HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "newUser", resp.body)
+	resp = routeResult(t, router, "POST /users%2F42 HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 404 Not Found", resp.statusLine)
+
+	// Test: Wildcard tail, any method
+	resp = routeResult(t, router, "PUT /static/css/site.css HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "static path=css/site.css", resp.body)
+	resp = routeResult(t, router, "GET /static/ HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "static path=", resp.body)
+	resp = routeResult(t, router, "GET /static/a%20b/c%2Fd HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "static path=a b/c/d", resp.body)
+
+	// Test: HEAD falls back to GET
+	resp = routeResult(t, router, "HEAD / HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "index", resp.body)
+
+	// Test: Unknown path
+	resp = routeResult(t, router, "GET /nope HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 404 Not Found", resp.statusLine)
+	resp = routeResult(t, router, "GET /users/ HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 404 Not Found", resp.statusLine)
+
+	// Test: Known path, wrong method
+	resp = routeResult(t, router, "PATCH /users/42 HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed", resp.statusLine)
+	assert.Equal(t, "DELETE, GET, HEAD", resp.headers["allow"])
+	resp = routeResult(t, router, "GET /users HTTP/1.1\r\n\r\n")
+	assert.Equal(t, "POST", resp.headers["allow"])
+}
+
+func TestRouterBadPatterns(t *testing.T) {
+	for _, pattern := range []string{
+		"users",                 // no leading slash
+		"/files/{path...}/edit", // wildcard not last
+		"/users/{}",             // unnamed parameter
+		"/users/{id",            // unbalanced brace
+	} {
+		assert.Panics(t, func() { NewRouter().Handle(pattern, named("x")) }, pattern)
+	}
+
+	// Test: Duplicate route
+	router := NewRouter()
+	router.Handle("GET /users/{id}", named("a"))
+	assert.Panics(t, func() { router.Handle("GET /users/{id}", named("b")) })
+
+	// Test: Conflicting parameter names at the same position
+	assert.Panics(t, func() { router.Handle("DELETE /users/{name}", named("c")) })
+}
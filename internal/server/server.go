@@ -1,14 +1,28 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"httpfromtcp/internal/http2"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"io"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// How long closeConn keeps draining a connection after the last response.
+const lingerTimeout = 500 * time.Millisecond
+
+// How much of a request body the handler didn't read gets skipped to keep
+// the connection alive. Anything bigger and it's cheaper to reconnect.
+const maxBodyDiscard = 256 << 10
+
 type ServerState int
 
 const (
@@ -21,11 +35,20 @@ type Server struct {
 	handler  Handler
 	listener net.Listener
 	closed   atomic.Bool
+	config   Config
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
 }
 
 // Creates a net.Listener and returns a new Server isntance.
 // Listener runs on a go routine
 func Serve(port int, handlerFunc Handler) (*Server, error) {
+	return ServeWithConfig(port, handlerFunc, Config{})
+}
+
+// Same as Serve but with a Config instead of the defaults.
+func ServeWithConfig(port int, handlerFunc Handler, config Config) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
@@ -33,17 +56,21 @@ func Serve(port int, handlerFunc Handler) (*Server, error) {
 	srv := &Server{
 		handler:  handlerFunc,
 		listener: listener,
+		config:   config,
+		conns:    map[*trackedConn]struct{}{},
 	}
 	go srv.listen()
 	return srv, nil
 }
 
-// Closes the listener and the server.
+// Closes the listener and every connection right away, requests in progress
+// are cut off. Use Shutdown to let them finish.
 func (s *Server) Close() error {
 	s.closed.Store(true)
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	s.closeAllConns()
 	return nil
 }
 
@@ -60,22 +87,301 @@ func (s *Server) listen() {
 			log.Printf("Server::listen::error > %v", err.Error())
 			return
 		}
-		go s.handle(conn)
+		go s.handle(s.trackConn(conn))
 	}
 }
 
-func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	req, err := request.RequestFromReader(conn)
-	w := response.NewWriter(conn)
-	if err != nil {
-		w.WriteStatusLine(response.StatusCodeInternalServerError)
-		w.WriteHeaders(response.GetDefaultHeaders(0))
-		w.WriteBody([]byte(fmt.Sprintf("Error parsing request: %v", err)))
+// Serves requests off a single connection until either side wants it closed.
+// After the first request, the connection gets IdleTimeout to send the next one.
+func (s *Server) handle(conn *trackedConn) {
+	hijacked := false
+	defer s.untrackConn(conn)
+	defer func() {
+		if !hijacked {
+			closeConn(conn.Conn)
+		}
+	}()
+	reader := request.NewReaderWithLimits(conn, s.config.limits())
+	if s.config.H2C && s.servePriorKnowledge(conn, reader) {
+		return
+	}
+	if s.config.MaxPipelinedRequests > 1 {
+		s.servePipelined(conn, reader)
 		return
 	}
+	for served := 0; ; served++ {
+		if served > 0 {
+			if reader.Buffered() == 0 {
+				conn.setIdle()
+			}
+			// Shutdown may have missed this one while it was busy
+			if s.closed.Load() && conn.isIdle() {
+				return
+			}
+		}
+		// a quiet connection is just closed, a slow request gets a 408
+		conn.SetReadDeadline(time.Now().Add(s.config.idleTimeout()))
+		if err := reader.WaitForData(); err != nil {
+			return
+		}
+		start := time.Now()
+		conn.SetReadDeadline(s.config.headerDeadline(start))
+		conn.SetWriteDeadline(s.config.writeDeadline(start))
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if isTimeout(err) {
+				writeRequestTimeout(response.NewWriter(conn))
+			} else if !isConnDone(err) {
+				writeParseError(response.NewWriter(conn), err)
+			}
+			return
+		}
+		conn.SetReadDeadline(s.config.readDeadline(start))
+		conn.SetWriteDeadline(s.config.writeDeadline(time.Now()))
+		if s.config.H2C && http2.IsUpgrade(req) {
+			// the body goes to the handler on stream 1, it has to be read
+			// before the connection switches over
+			if _, err := req.ReadBody(); err != nil {
+				if !isConnDone(err) {
+					writeParseError(response.NewWriter(conn), err)
+				}
+				return
+			}
+			s.serveHTTP2(conn, reader, req)
+			return
+		}
+
+		w := response.NewWriter(conn)
+		w.SetVersion(req.RequestLine.HttpVersion)
+		w.SetMethod(req.RequestLine.Method)
+		w.SetKeepAlive(s.keepAlive(req, served+1))
+		w.SetHijacker(func() (net.Conn, []byte, error) {
+			// from here on the connection is the handler's problem
+			hijacked = true
+			s.untrackConn(conn)
+			conn.SetDeadline(time.Time{})
+			return conn.Conn, reader.Detach(), nil
+		})
+		if req.ExpectsContinue() {
+			w.ExpectContinue()
+			req.BodyReader = &continueReader{ReadCloser: req.BodyReader, w: w}
+		}
+		s.runHandler(w, req)
+		if hijacked {
+			return
+		}
+		if errors.Is(reader.BodyErr(), request.ErrBodyTooLarge) {
+			writeBodyTooLarge(w)
+		}
+		if err := w.Finish(); err != nil {
+			log.Printf("Server::handle::error > %v", err)
+			return
+		}
+		if !w.KeepAlive() || !reader.DiscardBody(maxBodyDiscard) {
+			return
+		}
+	}
+}
+
+// Serves the connection as HTTP/2 if it starts with the client preface,
+// reporting whether it did.
+func (s *Server) servePriorKnowledge(conn *trackedConn, reader *request.Reader) bool {
+	conn.SetReadDeadline(time.Now().Add(s.config.idleTimeout()))
+	if err := reader.WaitForData(); err != nil {
+		return true
+	}
+	conn.SetReadDeadline(s.config.headerDeadline(time.Now()))
+	isHTTP2, err := reader.HasPrefix([]byte(http2.ClientPreface))
+	if err != nil {
+		return true
+	}
+	if isHTTP2 {
+		s.serveHTTP2(conn, reader, nil)
+	}
+	return isHTTP2
+}
+
+// Hands the connection over to HTTP/2, along with the request that asked
+// to upgrade to it if there's one. Shutdown has it send a GOAWAY and close
+// once its streams are done.
+func (s *Server) serveHTTP2(conn *trackedConn, reader *request.Reader, upgrade *request.Request) {
+	goAway := make(chan struct{})
+	s.mu.Lock()
+	conn.goAway = goAway
+	s.mu.Unlock()
+	if upgrade == nil {
+		conn.setIdle() // until the first stream opens
+	}
+	conn.SetDeadline(time.Time{})
+	// read off the plain conn, a frame coming in doesn't make it busy
+	r := io.MultiReader(bytes.NewReader(reader.Detach()), conn.Conn)
+	config := http2.Config{
+		Limits:      s.config.Limits,
+		IdleTimeout: s.config.idleTimeout(),
+		Shutdown:    goAway,
+		ConnState: func(idle bool) {
+			if idle {
+				conn.setIdle()
+			} else {
+				conn.setActive()
+			}
+		},
+	}
+	var err error
+	if upgrade != nil {
+		err = http2.ServeUpgrade(conn.Conn, r, s.runHandler, config, upgrade)
+	} else {
+		err = http2.ServeConn(conn.Conn, r, s.runHandler, config)
+	}
+	if err != nil && !isConnDone(err) {
+		log.Printf("Server::h2::error > %v", err)
+	}
+}
+
+// Runs the handler, recovering from a panic so one bad request doesn't take
+// down the whole process.
+func (s *Server) runHandler(w *response.Writer, req *request.Request) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Server::handle::panic > %s %s: %v\n%s",
+				req.RequestLine.Method, req.RequestLine.RequestTarget, rec, debug.Stack())
+			writePanicResponse(w)
+		}
+	}()
 	s.handler(w, req)
-	return
+}
+
+// The body of a request with Expect: 100-continue. The client only sends
+// the body once it's told to go ahead, so that's put off until the handler
+// asks for it, giving it the chance to turn the request down first.
+type continueReader struct {
+	io.ReadCloser
+	w *response.Writer
+}
+
+func (r *continueReader) Read(p []byte) (int, error) {
+	if err := r.w.WriteContinue(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// Answers with a 500 if the handler hadn't written anything yet, otherwise
+// aborts the response. Either way the connection is closed after.
+func writePanicResponse(w *response.Writer) {
+	if w.WriterState != response.WriteToStatusLine {
+		w.Abort()
+		return
+	}
+	w.SetKeepAlive(false)
+	body := []byte("Internal Server Error")
+	w.WriteStatusLine(response.StatusCodeInternalServerError)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// Answers a request whose body went over MaxBodyBytes while the handler was
+// reading it. Whatever the handler made of it is swapped for a 413 if none
+// of it is out yet, otherwise the response is aborted. The rest of the body
+// is still on the connection, so it's closed either way.
+func writeBodyTooLarge(w *response.Writer) {
+	if !w.Reset() {
+		w.Abort()
+		return
+	}
+	w.SetKeepAlive(false)
+	body := []byte(response.StatusText(response.StatusCodeContentTooLarge))
+	w.WriteStatusLine(response.StatusCodeContentTooLarge)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// Answers a request that didn't arrive within ReadHeaderTimeout.
+func writeRequestTimeout(w *response.Writer) {
+	body := []byte("Request Timeout")
+	w.WriteStatusLine(response.StatusCodeRequestTimeout)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+	w.Finish()
+}
+
+// Answers a request that couldn't be parsed. The connection is closed after.
+// The body is only the status text, parser errors can quote the request back
+// and that's nothing to echo to whoever sent it.
+func writeParseError(w *response.Writer, err error) {
+	log.Printf("Server::handle::parse > %v", err)
+	statusCode := parseErrorStatus(err)
+	body := []byte(response.StatusText(statusCode))
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+	w.Finish()
+}
+
+// Picks the status for a parse error. Anything the parser doesn't have a
+// more specific answer for is the client's fault.
+func parseErrorStatus(err error) response.StatusCode {
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusCodeURITooLong
+	case errors.Is(err, request.ErrHeaderTooLarge), errors.Is(err, request.ErrTooManyHeaders):
+		return response.StatusCodeHeaderTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusCodeContentTooLarge
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusCodeHTTPVersionNotSupported
+	case errors.Is(err, request.ErrUnsupportedTransferCoding):
+		return response.StatusCodeNotImplemented
+	case errors.Is(err, request.ErrUnsupportedExpectation):
+		return response.StatusCodeExpectationFailed
+	}
+	return response.StatusCodeBadRequest
+}
+
+// Closes the connection without losing the end of the last response.
+// Closing a socket that still has unread request bytes (e.g. pipelined
+// requests after a Connection: close) makes the kernel send a RST, which can
+// throw away data the client hasn't read yet. So stop writing first and
+// drain what the client still sends for a little while.
+func closeConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+		io.Copy(io.Discard, conn)
+	}
+	conn.Close()
+}
+
+// Decides whether the connection should stay open after responding to req,
+// the n-th request served on it.
+func (s *Server) keepAlive(req *request.Request, n int) bool {
+	if s.closed.Load() {
+		return false
+	}
+	if s.config.MaxRequestsPerConn > 0 && n >= s.config.MaxRequestsPerConn {
+		return false
+	}
+	if req.Headers.HasToken("Connection", "close") {
+		return false
+	}
+	// HTTP/1.1 connections are persistent unless told otherwise, 1.0 ones
+	// only when the client asks for it
+	if req.RequestLine.HttpVersion == "1.0" {
+		return req.Headers.HasToken("Connection", "keep-alive")
+	}
+	return true
+}
+
+// Reports whether a read error just means the client is gone or went quiet,
+// in which case there's nobody to send an error response to.
+func isConnDone(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || isTimeout(err)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
 // Handles a single connection by writing the following response and closing the connection.
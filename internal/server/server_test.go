@@ -0,0 +1,908 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/http2"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/websocket"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okHandler(w *response.Writer, req *request.Request) {
+	body := []byte("target: " + req.RequestLine.RequestTarget)
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// startServer listens on a random port and returns the server with a connection to it.
+func startServer(t *testing.T, handler Handler, config Config) (*Server, net.Conn) {
+	t.Helper()
+	srv, err := ServeWithConfig(0, handler, config)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return srv, conn
+}
+
+type testResponse struct {
+	statusLine string
+	headers    map[string]string
+	body       string
+}
+
+// readResponse reads one Content-Length framed response off the connection.
+func readResponse(t *testing.T, r *bufio.Reader) testResponse {
+	t.Helper()
+	resp := readResponseHead(t, r)
+	length, err := strconv.Atoi(resp.headers["content-length"])
+	require.NoError(t, err)
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+	resp.body = string(body)
+	return resp
+}
+
+// readResponseHead reads a status line and headers, leaving the body.
+func readResponseHead(t *testing.T, r *bufio.Reader) testResponse {
+	t.Helper()
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	resp := testResponse{
+		statusLine: strings.TrimRight(statusLine, "\r\n"),
+		headers:    map[string]string{},
+	}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		key, val, _ := strings.Cut(line, ":")
+		resp.headers[strings.ToLower(key)] = strings.TrimSpace(val)
+	}
+	return resp
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	// Test: several requests share one connection
+	_, conn := startServer(t, okHandler, Config{})
+	r := bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two", "/three"} {
+		_, err := conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		resp := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		assert.Equal(t, "target: "+target, resp.body)
+		assert.NotEqual(t, "close", resp.headers["connection"])
+	}
+
+	// Test: Connection: close from the client ends the connection
+	_, err := conn.Write([]byte("GET /bye HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, r)
+	assert.Equal(t, "close", resp.headers["connection"])
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerMaxRequestsPerConn(t *testing.T) {
+	_, conn := startServer(t, okHandler, Config{MaxRequestsPerConn: 2})
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("GET /1 HTTP/1.1\r\n\r\n"))
+	resp := readResponse(t, r)
+	assert.NotEqual(t, "close", resp.headers["connection"])
+
+	conn.Write([]byte("GET /2 HTTP/1.1\r\n\r\n"))
+	resp = readResponse(t, r)
+	assert.Equal(t, "close", resp.headers["connection"])
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	_, conn := startServer(t, okHandler, Config{IdleTimeout: 50 * time.Millisecond})
+	r := bufio.NewReader(conn)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	readResponse(t, r)
+	// nothing else is sent, the server should hang up on its own
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerEmptyHandler(t *testing.T) {
+	// Test: a handler that writes nothing still produces a response
+	_, conn := startServer(t, func(w *response.Writer, req *request.Request) {}, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+	assert.Equal(t, "", resp.body)
+}
+
+func TestServerPipelining(t *testing.T) {
+	// the first request is the slowest, its response must still come first
+	delays := map[string]time.Duration{"/a": 60 * time.Millisecond, "/b": 20 * time.Millisecond}
+	handler := func(w *response.Writer, req *request.Request) {
+		time.Sleep(delays[req.RequestLine.RequestTarget])
+		okHandler(w, req)
+	}
+	pipelined := "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\nGET /c HTTP/1.1\r\n\r\n"
+
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 2}, {MaxPipelinedRequests: 8}} {
+		_, conn := startServer(t, handler, config)
+		r := bufio.NewReader(conn)
+		_, err := conn.Write([]byte(pipelined))
+		require.NoError(t, err)
+		for _, target := range []string{"/a", "/b", "/c"} {
+			resp := readResponse(t, r)
+			assert.Equal(t, "target: "+target, resp.body)
+		}
+	}
+}
+
+func TestServerPipeliningLimit(t *testing.T) {
+	var running, most atomic.Int32
+	handler := func(w *response.Writer, req *request.Request) {
+		n := running.Add(1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+		okHandler(w, req)
+	}
+	_, conn := startServer(t, handler, Config{MaxPipelinedRequests: 2})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(strings.Repeat("GET /x HTTP/1.1\r\n\r\n", 8)))
+
+	// Test: no more than MaxPipelinedRequests handlers run at once
+	for range 8 {
+		assert.Equal(t, "target: /x", readResponse(t, r).body)
+	}
+	assert.Equal(t, int32(2), most.Load())
+}
+
+func TestServerPipeliningClose(t *testing.T) {
+	// Test: requests after a Connection: close aren't served
+	_, conn := startServer(t, okHandler, Config{MaxPipelinedRequests: 4})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\nConnection: close\r\n\r\nGET /c HTTP/1.1\r\n\r\n"))
+
+	assert.Equal(t, "target: /a", readResponse(t, r).body)
+	resp := readResponse(t, r)
+	assert.Equal(t, "target: /b", resp.body)
+	assert.Equal(t, "close", resp.headers["connection"])
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerRequestBody(t *testing.T) {
+	// echoes the body back, but only for /echo
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/echo" {
+			okHandler(w, req)
+			return
+		}
+		body, err := io.ReadAll(req.BodyReader)
+		require.NoError(t, err)
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	requests := "POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n" +
+		"POST /ignored HTTP/1.1\r\nContent-Length: 11\r\n\r\nnot read!!!" +
+		"GET /last HTTP/1.1\r\n\r\n"
+
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		_, conn := startServer(t, handler, config)
+		r := bufio.NewReader(conn)
+		conn.Write([]byte(requests))
+		assert.Equal(t, "abcde", readResponse(t, r).body)
+		assert.Equal(t, "target: /ignored", readResponse(t, r).body)
+		assert.Equal(t, "target: /last", readResponse(t, r).body)
+	}
+}
+
+func TestServerPipeliningBodyLimit(t *testing.T) {
+	chunk := strings.Repeat("a", 64<<10)
+	chunked := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		strings.Repeat(fmt.Sprintf("%x\r\n%s\r\n", len(chunk), chunk), DefaultMaxPipelinedBodyBytes/len(chunk)+1) +
+		"0\r\n\r\n"
+
+	// Test: with no MaxBodyBytes set, pipelined bodies still get a cap
+	for _, request := range []string{
+		fmt.Sprintf("POST / HTTP/1.1\r\nContent-Length: %d\r\n\r\n", DefaultMaxPipelinedBodyBytes+1),
+		chunked,
+	} {
+		_, conn := startServer(t, okHandler, Config{MaxPipelinedRequests: 4})
+		go conn.Write([]byte(request))
+		resp := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, "HTTP/1.1 413 Content Too Large", resp.statusLine)
+		assert.Equal(t, "close", resp.headers["connection"])
+	}
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	logOutput := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(logOutput)
+
+	handler := func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/early":
+			panic("before writing")
+		case "/late":
+			w.WriteStatusLine(response.StatusCodeSuccess)
+			w.WriteHeaders(response.GetDefaultHeaders(100))
+			w.WriteBody([]byte("partial"))
+			panic("after writing")
+		}
+		okHandler(w, req)
+	}
+
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		// Test: Panic before writing gets a 500 and the connection closes
+		srv, conn := startServer(t, handler, config)
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("GET /early HTTP/1.1\r\n\r\n"))
+		resp := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 500 Internal Server Error", resp.statusLine)
+		assert.Equal(t, "close", resp.headers["connection"])
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		// Test: The server keeps serving other connections
+		conn, err = net.Dial("tcp", srv.listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r = bufio.NewReader(conn)
+		conn.Write([]byte("GET /late HTTP/1.1\r\n\r\n"))
+		rest, err := io.ReadAll(r)
+		require.NoError(t, err)
+		if config.MaxPipelinedRequests > 1 {
+			// buffered responses haven't left yet, so they're swapped for a 500
+			assert.True(t, strings.HasPrefix(string(rest), "HTTP/1.1 500 Internal Server Error\r\n"), string(rest))
+		} else {
+			// the response was cut short, not completed with the wrong body
+			assert.True(t, strings.HasSuffix(string(rest), "\r\n\r\npartial"), string(rest))
+		}
+	}
+}
+
+func TestServerReadHeaderTimeout(t *testing.T) {
+	for _, config := range []Config{
+		{ReadHeaderTimeout: 100 * time.Millisecond},
+		{ReadHeaderTimeout: 100 * time.Millisecond, MaxPipelinedRequests: 4},
+	} {
+		// Test: A request trickling in gets a 408
+		_, conn := startServer(t, okHandler, config)
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("GET /slo"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("wloris HT"))
+		resp := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 408 Request Timeout", resp.statusLine)
+		assert.Equal(t, "close", resp.headers["connection"])
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+	}
+
+	// Test: A connection that never sends anything is closed without a response
+	_, conn := startServer(t, okHandler, Config{IdleTimeout: 50 * time.Millisecond, ReadHeaderTimeout: time.Second})
+	_, err := bufio.NewReader(conn).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	readErr := make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		_, err := io.ReadAll(req.BodyReader)
+		readErr <- err
+	}
+	_, conn := startServer(t, handler, Config{ReadTimeout: 100 * time.Millisecond})
+
+	// Test: The handler can't wait forever on a body that never shows up
+	conn.Write([]byte("POST /upload HTTP/1.1\r\nContent-Length: 100\r\n\r\nonly some"))
+	select {
+	case err := <-readErr:
+		assert.True(t, isTimeout(err), "%v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("body read never timed out")
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	config := Config{Limits: request.Limits{
+		MaxRequestLineBytes: 64,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        8,
+	}}
+	for _, tc := range []struct {
+		request    string
+		statusLine string
+	}{
+		{"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\n\r\n", "HTTP/1.1 414 URI Too Long"},
+		{"GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n", "HTTP/1.1 431 Request Header Fields Too Large"},
+		{"POST / HTTP/1.1\r\nContent-Length: 9\r\n\r\n123456789", "HTTP/1.1 413 Content Too Large"},
+	} {
+		_, conn := startServer(t, okHandler, config)
+		conn.Write([]byte(tc.request))
+		resp := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, tc.statusLine, resp.statusLine)
+		assert.Equal(t, "close", resp.headers["connection"])
+	}
+}
+
+func TestServerBodyTooLarge(t *testing.T) {
+	config := Config{Limits: request.Limits{MaxBodyBytes: 4}}
+	chunked := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n10\r\n0123456789abcdef\r\n0\r\n\r\n"
+
+	// Test: a chunked body going over the limit as the handler reads it gets
+	// a 413 in place of the handler's response
+	handler := func(w *response.Writer, req *request.Request) {
+		_, err := io.ReadAll(req.BodyReader)
+		assert.ErrorIs(t, err, request.ErrBodyTooLarge)
+		okHandler(w, req)
+	}
+	_, conn := startServer(t, handler, config)
+	r := bufio.NewReader(conn)
+	conn.Write([]byte(chunked))
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large", resp.statusLine)
+	assert.Equal(t, "close", resp.headers["connection"])
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: once the response is out it stays, but the connection is closed
+	handler = func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(2))
+		w.Flush()
+		io.ReadAll(req.BodyReader)
+		w.Write([]byte("ok"))
+	}
+	_, conn = startServer(t, handler, config)
+	r = bufio.NewReader(conn)
+	conn.Write([]byte(chunked))
+	resp = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+	assert.Equal(t, "ok", resp.body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		request    string
+		statusLine string
+	}{
+		{"GET / HTTP/1.1 extra\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"get / HTTP/1.1\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"GET / HTTP/2.0\r\n\r\n", "HTTP/1.1 505 HTTP Version Not Supported"},
+		{"GET / HTTP/1.1\r\nBad Key: 1\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", "HTTP/1.1 400 Bad Request"},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 2\r\n\r\nab", "HTTP/1.1 400 Bad Request"},
+		{"POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n", "HTTP/1.1 501 Not Implemented"},
+	} {
+		_, conn := startServer(t, okHandler, Config{})
+		conn.Write([]byte(tc.request))
+		resp := readResponse(t, bufio.NewReader(conn))
+		assert.Equal(t, tc.statusLine, resp.statusLine, tc.request)
+		assert.Equal(t, "close", resp.headers["connection"])
+		// the body never quotes the request back
+		assert.NotContains(t, resp.body, "extra")
+	}
+}
+
+func TestServerHTTP10(t *testing.T) {
+	// Test: a 1.0 request gets a 1.0 response and the connection closes
+	_, conn := startServer(t, okHandler, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET /old HTTP/1.0\r\n\r\n"))
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.0 200 OK", resp.statusLine)
+	assert.Equal(t, "close", resp.headers["connection"])
+	_, err := r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: keep-alive is opt-in and acknowledged
+	_, conn = startServer(t, okHandler, Config{})
+	r = bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two"} {
+		conn.Write([]byte("GET " + target + " HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+		resp = readResponse(t, r)
+		assert.Equal(t, "HTTP/1.0 200 OK", resp.statusLine)
+		assert.Equal(t, "keep-alive", resp.headers["connection"])
+		assert.Equal(t, "target: "+target, resp.body)
+	}
+
+	// Test: a chunked response goes out as a plain body ended by the close
+	chunked := func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(h)
+		w.WriteChunkedBody([]byte("hello "))
+		w.WriteChunkedBody([]byte("world"))
+		w.WriteChunkedBodyDone()
+	}
+	_, conn = startServer(t, chunked, Config{})
+	conn.Write([]byte("GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(raw), "HTTP/1.0 200 OK\r\n"))
+	assert.NotContains(t, strings.ToLower(string(raw)), "transfer-encoding")
+	assert.Contains(t, strings.ToLower(string(raw)), "connection: close\r\n")
+	assert.True(t, strings.HasSuffix(string(raw), "\r\n\r\nhello world"))
+}
+
+// readInterim reads a 1xx response, status line and headers, off r.
+func readInterim(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "\r\n" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func TestServerExpectContinue(t *testing.T) {
+	// echoes the body, turns down anything over 5 bytes without reading it
+	handler := func(w *response.Writer, req *request.Request) {
+		length, _ := req.Headers.Get("Content-Length")
+		if n, _ := strconv.Atoi(length); n > 5 {
+			body := []byte("too big")
+			w.WriteStatusLine(response.StatusCodeContentTooLarge)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+			return
+		}
+		body, err := io.ReadAll(req.BodyReader)
+		require.NoError(t, err)
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		// Test: the 100 comes before the client sends the body
+		_, conn := startServer(t, handler, config)
+		r := bufio.NewReader(conn)
+		for range 2 {
+			conn.Write([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+			assert.Equal(t, "HTTP/1.1 100 Continue", readInterim(t, r))
+			conn.Write([]byte("hello"))
+			resp := readResponse(t, r)
+			assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+			assert.Equal(t, "hello", resp.body)
+			assert.Empty(t, resp.headers["connection"])
+		}
+
+		// Test: no 100 for a request without a body
+		conn.Write([]byte("GET / HTTP/1.1\r\nExpect: 100-continue\r\n\r\n"))
+		assert.Equal(t, "HTTP/1.1 200 OK", readResponse(t, r).statusLine)
+	}
+
+	// Test: turned down without a 100, and the connection closes
+	_, conn := startServer(t, handler, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("POST / HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 9\r\n\r\n"))
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large", resp.statusLine)
+	assert.Equal(t, "close", resp.headers["connection"])
+
+	// Test: an expectation we don't know
+	_, conn = startServer(t, handler, Config{})
+	conn.Write([]byte("POST / HTTP/1.1\r\nExpect: something-else\r\nContent-Length: 1\r\n\r\na"))
+	resp = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed", resp.statusLine)
+}
+
+func TestServerEarlyHints(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		h := headers.NewHeaders()
+		h.Add("Link", "</style.css>; rel=preload; as=style")
+		h.Add("Link", "</app.js>; rel=preload; as=script")
+		require.NoError(t, w.WriteInformational(response.StatusCodeEarlyHints, h))
+		assert.Error(t, w.WriteInformational(101, nil))
+		assert.Error(t, w.WriteStatusLine(response.StatusCodeContinue))
+		okHandler(w, req)
+	}
+	_, conn := startServer(t, handler, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.1 103 Early Hints\n"+
+		"Link: </style.css>; rel=preload; as=style\n"+
+		"Link: </app.js>; rel=preload; as=script", readInterim(t, r))
+	assert.Equal(t, "HTTP/1.1 200 OK", readResponse(t, r).statusLine)
+
+	// Test: 1.0 clients only get the final response
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	assert.Equal(t, "HTTP/1.0 200 OK", readResponse(t, r).statusLine)
+}
+
+func TestServerWriterFraming(t *testing.T) {
+	// writes its body in pieces without ever setting headers
+	handler := func(w *response.Writer, req *request.Request) {
+		for _, part := range strings.Split(req.RequestLine.RequestTarget, "/") {
+			fmt.Fprintf(w, "[%s]", part)
+		}
+	}
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		_, conn := startServer(t, handler, config)
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("GET /a/b HTTP/1.1\r\n\r\nGET /c HTTP/1.1\r\n\r\n"))
+		resp := readResponse(t, r)
+		assert.Equal(t, "[][a][b]", resp.body)
+		assert.Equal(t, "8", resp.headers["content-length"])
+		assert.Equal(t, "[][c]", readResponse(t, r).body)
+	}
+}
+
+func TestServerHead(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/chunked" {
+			okHandler(w, req)
+			return
+		}
+		w.Write([]byte("streamed"))
+		w.Flush()
+		w.WriteChunkedBodyDone()
+		trailers := headers.NewHeaders()
+		trailers.Set("X-Checksum", "abc")
+		w.WriteTrailers(trailers)
+	}
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		_, conn := startServer(t, handler, config)
+		r := bufio.NewReader(conn)
+
+		// Test: a HEAD gets the GET's Content-Length and no body, the
+		// next response on the connection starts right after its headers
+		conn.Write([]byte("HEAD /x HTTP/1.1\r\n\r\n"))
+		resp := readResponseHead(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		assert.Equal(t, strconv.Itoa(len("target: /x")), resp.headers["content-length"])
+		assert.NotEqual(t, "close", resp.headers["connection"])
+		conn.Write([]byte("GET /x HTTP/1.1\r\n\r\n"))
+		resp = readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		assert.Equal(t, "target: /x", resp.body)
+
+		// Test: a chunked HEAD says so, without chunks or trailers
+		conn.Write([]byte("HEAD /chunked HTTP/1.1\r\n\r\n"))
+		resp = readResponseHead(t, r)
+		assert.Equal(t, "chunked", resp.headers["transfer-encoding"])
+		conn.Write([]byte("GET /x HTTP/1.1\r\n\r\n"))
+		resp = readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK", resp.statusLine)
+		assert.Equal(t, "target: /x", resp.body)
+	}
+}
+
+func TestServerFlush(t *testing.T) {
+	// sends the first piece, then waits for the test to have read it
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("first"))
+		w.Flush()
+		<-release
+		w.Write([]byte("second"))
+	}
+	_, conn := startServer(t, handler, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	// Test: the flushed part arrives while the handler is still running
+	var head strings.Builder
+	for !strings.HasSuffix(head.String(), "\r\n\r\n") {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+	}
+	assert.Contains(t, head.String(), "Transfer-Encoding: chunked")
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "5\r\n", line)
+	close(release)
+
+	// Test: the rest comes once the handler returns
+	rest, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first\r\n", rest)
+	tail := make([]byte, len("6\r\nsecond\r\n0\r\n\r\n"))
+	_, err = io.ReadFull(r, tail)
+	require.NoError(t, err)
+	assert.Equal(t, "6\r\nsecond\r\n0\r\n\r\n", string(tail))
+}
+
+func TestServerEventStream(t *testing.T) {
+	stopped := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) {
+		defer close(stopped)
+		s, err := response.NewEventStream(w, 5*time.Millisecond)
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.Send(response.Event{Data: "hello"})
+		<-s.Done()
+	}
+	_, conn := startServer(t, handler, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET /events HTTP/1.1\r\n\r\n"))
+
+	// Test: the event arrives while the handler is still going
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		if line == "data: hello\n" {
+			break
+		}
+	}
+
+	// Test: the handler finds out once the client hangs up
+	conn.Close()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler still streaming after the client left")
+	}
+}
+
+func TestServerWebSocket(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		ws, err := websocket.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			msgType, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(msgType, msg)
+		}
+	}
+	_, conn := startServer(t, handler, Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+
+	// Test: the handshake is answered with a 101
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	var head strings.Builder
+	for !strings.HasSuffix(head.String(), "\r\n\r\n") {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		head.WriteString(line)
+	}
+	assert.Contains(t, head.String(), "Sec-Websocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n")
+
+	// Test: frames go both ways on the hijacked connection, the masked
+	// "Hello" from RFC 6455 5.7 comes back unmasked
+	conn.Write([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	echo := make([]byte, 7)
+	_, err = io.ReadFull(r, echo)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x81, 0x05, 'H', 'e', 'l', 'l', 'o'}, echo)
+
+	// Test: closing is answered and the server hangs up
+	conn.Write([]byte{0x88, 0x82, 0, 0, 0, 0, 0x03, 0xe8})
+	closeFrame := make([]byte, 4)
+	_, err = io.ReadFull(r, closeFrame)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x88, 0x02, 0x03, 0xe8}, closeFrame)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: while pipelining there's no connection to hand over, the client
+	// gets a 501 instead of an empty 200
+	_, conn = startServer(t, handler, Config{MaxPipelinedRequests: 2})
+	r = bufio.NewReader(conn)
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	resp := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 501 Not Implemented", resp.statusLine)
+	assert.Equal(t, "close", resp.headers["connection"])
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestServerHijack(t *testing.T) {
+	type hijacked struct {
+		conn     net.Conn
+		buffered []byte
+	}
+	taken := make(chan hijacked, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		conn, buffered, err := w.Hijack()
+		if err != nil {
+			return
+		}
+		taken <- hijacked{conn, buffered}
+	}
+	srv, conn := startServer(t, handler, Config{ReadHeaderTimeout: 50 * time.Millisecond, ReadTimeout: 50 * time.Millisecond})
+	conn.Write([]byte("GET /line HTTP/1.1\r\nUpgrade: line\r\nConnection: Upgrade\r\n\r\nHELLO\n"))
+	h := <-taken
+	defer h.conn.Close()
+
+	// Test: bytes the parser read ahead come with the connection
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(h.buffered), h.conn))
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO\n", line)
+
+	// Test: Shutdown doesn't wait for it or close it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+
+	// Test: nor do the server's timeouts apply anymore
+	time.Sleep(100 * time.Millisecond)
+	conn.Write([]byte("AGAIN\n"))
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "AGAIN\n", line)
+	h.conn.Write([]byte("BYE\n"))
+	line, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "BYE\n", line)
+}
+
+// readH2Response reads frames off r up to the end of stream id, returning
+// its header fields and body.
+func readH2Response(t *testing.T, r io.Reader, dec *http2.Decoder, id uint32) (map[string]string, string) {
+	t.Helper()
+	fields := map[string]string{}
+	var body strings.Builder
+	for {
+		f, err := http2.ReadFrame(r, 1<<14)
+		require.NoError(t, err)
+		if f.Type == http2.FrameHeaders {
+			// decoded whatever the stream, to keep the table in step
+			decoded, err := dec.Decode(f.Payload)
+			require.NoError(t, err)
+			for _, hf := range decoded {
+				if f.StreamID == id {
+					fields[hf.Name] = hf.Value
+				}
+			}
+		}
+		if f.StreamID != id {
+			continue
+		}
+		switch f.Type {
+		case http2.FrameData:
+			body.Write(f.Payload)
+		}
+		if (f.Type == http2.FrameHeaders || f.Type == http2.FrameData) && f.Has(http2.FlagEndStream) {
+			return fields, body.String()
+		}
+	}
+}
+
+func writeH2Get(t *testing.T, conn net.Conn, enc *http2.Encoder, id uint32, path string) {
+	t.Helper()
+	block := enc.Encode([]http2.HeaderField{
+		{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path}, {Name: ":authority", Value: "localhost"},
+	})
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{
+		Type: http2.FrameHeaders, Flags: http2.FlagEndHeaders | http2.FlagEndStream, StreamID: id, Payload: block,
+	}))
+}
+
+func TestServerH2C(t *testing.T) {
+	srv, conn := startServer(t, slowHandler(200*time.Millisecond), Config{H2C: true})
+	enc, dec := http2.NewEncoder(), http2.NewDecoder()
+
+	// Test: a client with prior knowledge is served HTTP/2
+	conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+	writeH2Get(t, conn, enc, 1, "/one")
+	fields, body := readH2Response(t, conn, dec, 1)
+	assert.Equal(t, "200", fields[":status"])
+	assert.Equal(t, "target: /one", body)
+	writeH2Get(t, conn, enc, 3, "/two")
+	_, body = readH2Response(t, conn, dec, 3)
+	assert.Equal(t, "target: /two", body)
+
+	// Test: HTTP/1 clients are still served as before
+	other, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	defer other.Close()
+	other.Write([]byte("GET /plain HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	resp := readResponse(t, bufio.NewReader(other))
+	assert.Equal(t, "target: /plain", resp.body)
+
+	// Test: Shutdown sends a GOAWAY naming the last stream it answers
+	other.Close()
+	writeH2Get(t, conn, enc, 5, "/slow")
+	time.Sleep(50 * time.Millisecond) // let the handler start
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(ctx) }()
+	var f http2.Frame
+	for f.Type != http2.FrameGoAway {
+		f, err = http2.ReadFrame(conn, 1<<14)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, uint32(5), binary.BigEndian.Uint32(f.Payload[:4]))
+
+	// Test: the stream still gets its response, then the connection closes
+	_, body = readH2Response(t, conn, dec, 5)
+	assert.Equal(t, "target: /slow", body)
+	require.NoError(t, <-shutdownErr)
+	_, err = io.Copy(io.Discard, conn)
+	assert.NoError(t, err)
+}
+
+func TestServerH2CUpgrade(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		body, _ := io.ReadAll(req.BodyReader)
+		msg := []byte(req.RequestLine.HttpVersion + " " + req.RequestLine.RequestTarget + " " + string(body))
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(msg)))
+		w.WriteBody(msg)
+	}
+	_, conn := startServer(t, handler, Config{H2C: true})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("POST /up HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\nContent-Length: 2\r\n\r\nhi"))
+
+	// Test: the upgrade is answered with a 101, then the response to the
+	// request comes on stream 1
+	status, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+	for line := ""; line != "\r\n"; {
+		line, err = r.ReadString('\n')
+		require.NoError(t, err)
+	}
+	dec := http2.NewDecoder()
+	fields, body := readH2Response(t, r, dec, 1)
+	assert.Equal(t, "200", fields[":status"])
+	assert.Equal(t, "1.1 /up hi", body)
+
+	// Test: the connection carries on as HTTP/2
+	conn.Write([]byte(http2.ClientPreface))
+	require.NoError(t, http2.WriteFrame(conn, http2.Frame{Type: http2.FrameSettings}))
+	writeH2Get(t, conn, http2.NewEncoder(), 3, "/next")
+	_, body = readH2Response(t, r, dec, 3)
+	assert.Equal(t, "2.0 /next ", body)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// How often Shutdown checks for connections that went idle.
+const shutdownPollInterval = 20 * time.Millisecond
+
+type connState int32
+
+const (
+	connState_new    connState = iota // accepted, nothing read yet
+	connState_idle                    // waiting for a request
+	connState_active                  // a request is being read or handled
+)
+
+// trackedConn is a connection the server knows about so Shutdown can tell
+// which ones are busy. Any bytes coming in mark it active, the serving loop
+// marks it idle again between requests. A new one may have its first
+// request on the way already, so it only counts as idle once it's been
+// quiet for Config.NewConnGracePeriod.
+type trackedConn struct {
+	net.Conn
+	state atomic.Int32
+	// a new connection counts as idle after this
+	graceEnd time.Time
+
+	// set while it's served as HTTP/2, closing it has the connection send
+	// a GOAWAY and end once its streams are done. Guarded by Server.mu.
+	goAway    chan struct{}
+	goingAway bool
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.state.Store(int32(connState_active))
+	}
+	return n, err
+}
+
+func (c *trackedConn) setIdle() {
+	c.state.Store(int32(connState_idle))
+}
+
+func (c *trackedConn) setActive() {
+	c.state.Store(int32(connState_active))
+}
+
+func (c *trackedConn) isIdle() bool {
+	switch connState(c.state.Load()) {
+	case connState_idle:
+		return true
+	case connState_new:
+		return time.Now().After(c.graceEnd)
+	}
+	return false
+}
+
+func (s *Server) trackConn(conn net.Conn) *trackedConn {
+	tc := &trackedConn{Conn: conn, graceEnd: time.Now().Add(s.config.newConnGracePeriod())}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[tc] = struct{}{}
+	return tc
+}
+
+func (s *Server) untrackConn(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, tc)
+}
+
+// Shutdown stops the server without cutting off requests in progress.
+// It stops accepting, closes connections sitting idle between requests and
+// waits for the rest to finish their current response before closing them
+// too. Connections that haven't sent anything yet get
+// Config.NewConnGracePeriod to start on a request. If ctx ends first the remaining connections are
+// closed anyway and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closed.Store(true)
+	s.listener.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Closes every idle connection and has the HTTP/2 ones go away, returns
+// how many are still open.
+func (s *Server) closeIdleConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	active := 0
+	for tc := range s.conns {
+		if tc.goAway != nil {
+			if !tc.goingAway {
+				close(tc.goAway)
+				tc.goingAway = true
+			}
+			active++ // until it closes itself
+			continue
+		}
+		if tc.isIdle() {
+			tc.Close()
+			delete(s.conns, tc)
+			continue
+		}
+		active++
+	}
+	return active
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tc := range s.conns {
+		tc.Close()
+		delete(s.conns, tc)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowHandler answers /slow after delay and everything else right away.
+func slowHandler(delay time.Duration) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			time.Sleep(delay)
+		}
+		okHandler(w, req)
+	}
+}
+
+func dial(t *testing.T, srv *Server) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestShutdownDrains(t *testing.T) {
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		srv, busy := startServer(t, slowHandler(200*time.Millisecond), config)
+
+		// an idle keep-alive connection, done with its first request
+		idle := dial(t, srv)
+		idleReader := bufio.NewReader(idle)
+		idle.Write([]byte("GET /fast HTTP/1.1\r\n\r\n"))
+		readResponse(t, idleReader)
+
+		busyReader := bufio.NewReader(busy)
+		busy.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+		time.Sleep(50 * time.Millisecond) // let the handler start
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr := make(chan error, 1)
+		go func() { shutdownErr <- srv.Shutdown(ctx) }()
+
+		// Test: Idle connection is closed right away
+		_, err := idleReader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		// Test: In-flight request still gets its response, then the connection closes
+		resp := readResponse(t, busyReader)
+		assert.Equal(t, "target: /slow", resp.body)
+		_, err = busyReader.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+
+		require.NoError(t, <-shutdownErr)
+
+		// Test: No new connections
+		_, err = net.Dial("tcp", srv.listener.Addr().String())
+		assert.Error(t, err)
+	}
+}
+
+func TestShutdownNewConn(t *testing.T) {
+	for _, config := range []Config{{}, {MaxPipelinedRequests: 4}} {
+		srv, conn := startServer(t, okHandler, config)
+		r := bufio.NewReader(conn)
+		time.Sleep(50 * time.Millisecond) // let the server accept it
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr := make(chan error, 1)
+		go func() { shutdownErr <- srv.Shutdown(ctx) }()
+		time.Sleep(3 * shutdownPollInterval)
+
+		// Test: a connection that hasn't sent its first request yet isn't
+		// taken for an idle one
+		conn.Write([]byte("GET /late HTTP/1.1\r\n\r\n"))
+		resp := readResponse(t, r)
+		assert.Equal(t, "target: /late", resp.body)
+		_, err := r.ReadByte()
+		assert.ErrorIs(t, err, io.EOF)
+		require.NoError(t, <-shutdownErr)
+	}
+}
+
+func TestShutdownNewConnGracePeriod(t *testing.T) {
+	srv, conn := startServer(t, okHandler, Config{NewConnGracePeriod: 100 * time.Millisecond})
+	time.Sleep(50 * time.Millisecond)
+
+	// Test: a connection that never sends anything is closed once its grace
+	// period is over
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	assert.Less(t, time.Since(start), time.Second)
+	_, err := bufio.NewReader(conn).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	srv, conn := startServer(t, slowHandler(2*time.Second), Config{})
+	r := bufio.NewReader(conn)
+	conn.Write([]byte("GET /slow HTTP/1.1\r\n\r\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	// Test: Stragglers are cut off once the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := srv.Shutdown(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	_, err = r.ReadByte()
+	assert.Error(t, err)
+}
@@ -0,0 +1,214 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+// Same values as the opcodes that start them.
+const (
+	TextMessage   MessageType = MessageType(opText)
+	BinaryMessage MessageType = MessageType(opBinary)
+)
+
+// DefaultMaxMessageSize is the largest message ReadMessage takes unless the
+// Conn says otherwise.
+const DefaultMaxMessageSize = 1 << 20
+
+// Messages longer than this are sent as several frames.
+const defaultFrameSize = 16 << 10
+
+// Conn is one end of a WebSocket connection. ReadMessage should only be
+// called from one goroutine at a time, writes can come from anywhere.
+type Conn struct {
+	conn   net.Conn
+	r      io.Reader
+	client bool // a client masks what it sends, a server expects it masked
+
+	// MaxMessageSize caps the size of a message ReadMessage puts together
+	// from its frames, a bigger one fails the connection with a 1009.
+	MaxMessageSize int
+	frameSize      int
+	readErr        error // sticky, the connection's done once it's set
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+func newConn(conn net.Conn, r io.Reader, client bool) *Conn {
+	return &Conn{
+		conn:           conn,
+		r:              r,
+		client:         client,
+		MaxMessageSize: DefaultMaxMessageSize,
+		frameSize:      defaultFrameSize,
+	}
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// ReadMessage returns the next text or binary message, put back together
+// from its fragments. Pings are answered and pongs skipped along the way.
+// Once the peer closes the connection the error is a *CloseError, a frame
+// breaking the protocol fails the connection with the matching close code.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	var (
+		msgType MessageType
+		msg     []byte
+		started bool
+	)
+	for {
+		f, err := readFrame(c.r, !c.client, c.MaxMessageSize-len(msg))
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		switch f.opcode {
+		case opPing:
+			if err := c.writeControl(opPong, f.payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, c.fail(err)
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(f.payload)
+		case opText, opBinary:
+			if started {
+				return 0, nil, c.fail(fmt.Errorf("%w: new message before the last one ended", ErrProtocol))
+			}
+			started = true
+			msgType = MessageType(f.opcode)
+		case opContinuation:
+			if !started {
+				return 0, nil, c.fail(fmt.Errorf("%w: continuation frame outside a message", ErrProtocol))
+			}
+		}
+		msg = append(msg, f.payload...)
+		if !f.fin {
+			continue
+		}
+		if msgType == TextMessage && !utf8.Valid(msg) {
+			return 0, nil, c.fail(ErrInvalidUTF8)
+		}
+		return msgType, msg, nil
+	}
+}
+
+// The peer wants to close: answer with the same code and hang up.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(fmt.Errorf("%w: truncated close code", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !validCloseCode(closeErr.Code) {
+			return c.fail(fmt.Errorf("%w: close code %d", ErrProtocol, closeErr.Code))
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(ErrInvalidUTF8)
+		}
+	}
+	var reply []byte
+	if closeErr.Code != CloseNoStatus {
+		reply = payload[:2]
+	}
+	c.writeControl(opClose, reply)
+	c.conn.Close()
+	c.readErr = closeErr
+	return closeErr
+}
+
+// fail ends the connection over err, telling the peer why when err is
+// about what it sent rather than the connection itself.
+func (c *Conn) fail(err error) error {
+	code := 0
+	switch {
+	case errors.Is(err, ErrProtocol):
+		code = CloseProtocolError
+	case errors.Is(err, ErrMessageTooBig):
+		code = CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8):
+		code = CloseInvalidPayload
+	}
+	if code != 0 {
+		c.WriteClose(code, "")
+	}
+	c.conn.Close()
+	c.readErr = err
+	return err
+}
+
+// WriteMessage sends data as one message, split into frames if it's long.
+func (c *Conn) WriteMessage(msgType MessageType, data []byte) error {
+	if msgType != TextMessage && msgType != BinaryMessage {
+		return fmt.Errorf("unknown message type %d", msgType)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	op := opcode(msgType)
+	var buf []byte
+	for {
+		n := min(len(data), c.frameSize)
+		buf = appendFrame(buf, frame{fin: n == len(data), opcode: op, payload: data[:n]}, c.client)
+		data = data[n:]
+		op = opContinuation
+		if len(data) == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// WritePing sends a ping, data is at most 125 bytes.
+func (c *Conn) WritePing(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+// WriteClose starts the closing handshake, the peer's answer shows up as a
+// *CloseError from ReadMessage. Nothing can be written after it.
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeControl(opClose, append(payload, reason...))
+}
+
+func (c *Conn) writeControl(op opcode, payload []byte) error {
+	if len(payload) > maxControlPayload {
+		return fmt.Errorf("control frame payload too long: %d", len(payload))
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(appendFrame(nil, frame{fin: true, opcode: op, payload: payload}, c.client))
+	return err
+}
+
+// Close sends a normal close if none was sent yet and closes the
+// connection without waiting for the peer's answer.
+func (c *Conn) Close() error {
+	c.WriteClose(CloseNormal, "")
+	return c.conn.Close()
+}
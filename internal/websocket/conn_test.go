@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pair returns the server and client ends of a connection.
+func pair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	return newConn(a, a, false), newConn(b, b, true)
+}
+
+// send writes raw frames from the client without waiting on the server.
+func send(c *Conn, frames ...frame) {
+	var buf []byte
+	for _, f := range frames {
+		buf = appendFrame(buf, f, c.client)
+	}
+	go c.conn.Write(buf)
+}
+
+func TestConnMessages(t *testing.T) {
+	server, client := pair(t)
+
+	// Test: text and binary both ways
+	go client.WriteMessage(TextMessage, []byte("hello"))
+	msgType, msg, err := server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, msgType)
+	assert.Equal(t, "hello", string(msg))
+
+	go server.WriteMessage(BinaryMessage, []byte{0, 1, 2})
+	msgType, msg, err = client.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, msgType)
+	assert.Equal(t, []byte{0, 1, 2}, msg)
+
+	// Test: long messages use the 16 and 64 bit lengths, and get fragmented
+	for _, size := range []int{200, 70000} {
+		big := bytes.Repeat([]byte("x"), size)
+		go client.WriteMessage(BinaryMessage, big)
+		_, msg, err = server.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, big, msg)
+	}
+
+	// Test: fragments with a ping in the middle, which gets a pong
+	send(client,
+		frame{opcode: opText, payload: []byte("frag")},
+		frame{fin: true, opcode: opPing, payload: []byte("p")},
+		frame{opcode: opContinuation, payload: []byte("men")},
+		frame{fin: true, opcode: opContinuation, payload: []byte("ted")},
+	)
+	pong := make(chan frame)
+	go func() {
+		f, _ := readFrame(client.r, false, 125)
+		pong <- f
+	}()
+	_, msg, err = server.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "fragmented", string(msg))
+	assert.Equal(t, frame{fin: true, opcode: opPong, payload: []byte("p")}, <-pong)
+}
+
+func TestConnClose(t *testing.T) {
+	server, client := pair(t)
+
+	// Test: a close is answered with the same code
+	go client.WriteClose(CloseGoingAway, "bye")
+	reply := make(chan error)
+	go func() {
+		_, _, err := client.ReadMessage()
+		reply <- err
+	}()
+	_, _, err := server.ReadMessage()
+	assert.Equal(t, &CloseError{Code: CloseGoingAway, Reason: "bye"}, err)
+	assert.Equal(t, &CloseError{Code: CloseGoingAway}, <-reply)
+	assert.ErrorIs(t, server.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+}
+
+func TestConnProtocolErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		frames []frame
+		masked bool // sent by a client that doesn't mask
+		err    error
+		code   int
+	}{
+		{"Unmasked", []frame{{fin: true, opcode: opText, payload: []byte("hi")}}, false, ErrProtocol, CloseProtocolError},
+		{"Unknown opcode", []frame{{fin: true, opcode: 0x3}}, true, ErrProtocol, CloseProtocolError},
+		{"Fragmented ping", []frame{{opcode: opPing}}, true, ErrProtocol, CloseProtocolError},
+		{"Long ping", []frame{{fin: true, opcode: opPing, payload: make([]byte, 126)}}, true, ErrProtocol, CloseProtocolError},
+		{"Stray continuation", []frame{{fin: true, opcode: opContinuation}}, true, ErrProtocol, CloseProtocolError},
+		{"Message inside a message", []frame{{opcode: opText}, {fin: true, opcode: opText}}, true, ErrProtocol, CloseProtocolError},
+		{"Invalid UTF-8", []frame{{fin: true, opcode: opText, payload: []byte{0xff}}}, true, ErrInvalidUTF8, CloseInvalidPayload},
+		{"Reserved close code", []frame{{fin: true, opcode: opClose, payload: []byte{0x03, 0xed}}}, true, ErrProtocol, CloseProtocolError},
+		{"Too big", []frame{{fin: true, opcode: opBinary, payload: make([]byte, 11)}}, true, ErrMessageTooBig, CloseMessageTooBig},
+		{"Too big in fragments", []frame{{opcode: opBinary, payload: make([]byte, 6)}, {fin: true, opcode: opContinuation, payload: make([]byte, 6)}}, true, ErrMessageTooBig, CloseMessageTooBig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := pair(t)
+			server.MaxMessageSize = 10
+			client.client = tc.masked
+			send(client, tc.frames...)
+			closed := make(chan frame)
+			go func() {
+				f, _ := readFrame(client.r, false, 125)
+				closed <- f
+			}()
+			_, _, err := server.ReadMessage()
+			assert.ErrorIs(t, err, tc.err)
+			f := <-closed
+			require.Equal(t, opClose, f.opcode)
+			assert.Equal(t, tc.code, int(binary.BigEndian.Uint16(f.payload)))
+
+			// Test: the connection stays failed
+			_, _, again := server.ReadMessage()
+			assert.Equal(t, err, again)
+		})
+	}
+
+	// Test: RSV bits without an extension
+	server, client := pair(t)
+	go client.conn.Write([]byte{0x80 | 0x40 | byte(opText), 0x80, 0, 0, 0, 0})
+	go readFrame(client.r, false, 125)
+	_, _, err := server.ReadMessage()
+	assert.ErrorIs(t, err, ErrProtocol)
+	assert.True(t, strings.Contains(err.Error(), "reserved"))
+}
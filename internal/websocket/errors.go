@@ -0,0 +1,56 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by Upgrade and Conn, check them with errors.Is.
+var (
+	ErrBadHandshake = errors.New("bad websocket handshake")
+	// ErrProtocol is a frame breaking RFC 6455, the connection is failed
+	// with a 1002 close.
+	ErrProtocol      = errors.New("websocket protocol error")
+	ErrMessageTooBig = errors.New("websocket message too big")
+	ErrInvalidUTF8   = errors.New("invalid UTF-8 in websocket message")
+	// ErrCloseSent is returned by writes once a close frame went out.
+	ErrCloseSent = errors.New("websocket close already sent")
+)
+
+// Close codes, RFC 6455 7.4.1.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // never sent, the peer's close had no code
+	CloseAbnormal        = 1006 // never sent, the connection just dropped
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// CloseError is returned by ReadMessage once the peer sent a close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Codes a close frame may carry, the rest are reserved or only meant for
+// reporting a close locally.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
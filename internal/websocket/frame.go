@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type opcode byte
+
+const (
+	opContinuation opcode = 0x0
+	opText         opcode = 0x1
+	opBinary       opcode = 0x2
+	opClose        opcode = 0x8
+	opPing         opcode = 0x9
+	opPong         opcode = 0xA
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+// Control frames can't be fragmented and carry at most this much.
+const maxControlPayload = 125
+
+type frame struct {
+	fin     bool
+	opcode  opcode
+	payload []byte
+}
+
+// readFrame reads one frame off r. masked is whether the frame has to be
+// masked: everything a client sends is, nothing a server sends is. A
+// payload longer than limit is ErrMessageTooBig, it isn't read.
+func readFrame(r io.Reader, masked bool, limit int) (frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{fin: head[0]&0x80 != 0, opcode: opcode(head[0] & 0x0f)}
+	if head[0]&0x70 != 0 {
+		return frame{}, fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	switch f.opcode {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+	default:
+		return frame{}, fmt.Errorf("%w: unknown opcode %#x", ErrProtocol, f.opcode)
+	}
+	if (head[1]&0x80 != 0) != masked {
+		return frame{}, fmt.Errorf("%w: masking is wrong for this side", ErrProtocol)
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return frame{}, fmt.Errorf("%w: payload length out of range", ErrProtocol)
+		}
+	}
+	if f.opcode.isControl() && (!f.fin || length > maxControlPayload) {
+		return frame{}, fmt.Errorf("%w: fragmented or oversized control frame", ErrProtocol)
+	}
+	if length > uint64(limit) {
+		return frame{}, fmt.Errorf("%w: %d byte frame", ErrMessageTooBig, length)
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return frame{}, err
+		}
+	}
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	if masked {
+		maskBytes(key, f.payload)
+	}
+	return f, nil
+}
+
+// appendFrame appends f to buf, masked with a random key if mask is set.
+func appendFrame(buf []byte, f frame, mask bool) []byte {
+	b0 := byte(f.opcode)
+	if f.fin {
+		b0 |= 0x80
+	}
+	var b1 byte
+	if mask {
+		b1 = 0x80
+	}
+	length := len(f.payload)
+	switch {
+	case length < 126:
+		buf = append(buf, b0, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b0, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b0, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+	if !mask {
+		return append(buf, f.payload...)
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	buf = append(buf, key[:]...)
+	start := len(buf)
+	buf = append(buf, f.payload...)
+	maskBytes(key, buf[start:])
+	return buf
+}
+
+// Masking and unmasking are the same XOR.
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
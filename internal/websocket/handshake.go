@@ -0,0 +1,104 @@
+// Package websocket speaks RFC 6455 over a connection taken over from the
+// server with response.Writer.Hijack.
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"io"
+	"strings"
+)
+
+// Appended to the client's key to work out Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// AcceptKey returns the Sec-WebSocket-Accept for a Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Upgrade checks req is a WebSocket opening handshake, takes the connection
+// over and answers with a 101. A request that isn't one is answered with a
+// 400, or a 426 for a version other than 13, and the error wraps
+// ErrBadHandshake. If the connection can't be taken over, while pipelining
+// or over HTTP/2 say, the answer is a 501, or a 500 if taking it over
+// failed, and the connection is closed after. Neither subprotocols nor
+// extensions are negotiated.
+func Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	key, err := checkHandshake(req)
+	if err != nil {
+		statusCode := response.StatusCodeBadRequest
+		h := headers.NewHeaders()
+		if _, ok := req.Headers.Get("Sec-WebSocket-Version"); ok && !req.Headers.HasToken("Sec-WebSocket-Version", "13") {
+			statusCode = response.StatusCodeUpgradeRequired
+			h.Set("Sec-WebSocket-Version", "13")
+		}
+		reject(w, statusCode, h)
+		return nil, err
+	}
+
+	conn, buffered, err := w.Hijack()
+	if err != nil {
+		statusCode := response.StatusCodeInternalServerError
+		if errors.Is(err, response.ErrNotHijackable) {
+			statusCode = response.StatusCodeNotImplemented
+		}
+		h := headers.NewHeaders()
+		h.Set("Connection", "close")
+		reject(w, statusCode, h)
+		return nil, err
+	}
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	var buf bytes.Buffer
+	response.WriteStatusLine(&buf, response.StatusCodeSwitchingProtocols)
+	response.WriteHeaders(&buf, h)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the client may not have waited for the 101 to send its first frames
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn))
+	return newConn(conn, r, false), nil
+}
+
+// Answers a request that won't be upgraded with statusCode, h goes along
+// with it.
+func reject(w *response.Writer, statusCode response.StatusCode, h *headers.Headers) {
+	body := []byte(response.StatusText(statusCode))
+	h.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	h.Set("Content-Type", "text/plain")
+	w.WriteStatusLine(statusCode)
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
+
+// RFC 6455 4.2.1, returns the client's key.
+func checkHandshake(req *request.Request) (string, error) {
+	if req.RequestLine.Method != "GET" || req.RequestLine.HttpVersion != "1.1" {
+		return "", fmt.Errorf("%w: %s over HTTP/%s", ErrBadHandshake,
+			req.RequestLine.Method, req.RequestLine.HttpVersion)
+	}
+	if !req.Headers.HasToken("Connection", "upgrade") || !req.Headers.HasToken("Upgrade", "websocket") {
+		return "", fmt.Errorf("%w: not an upgrade to websocket", ErrBadHandshake)
+	}
+	if !req.Headers.HasToken("Sec-WebSocket-Version", "13") {
+		return "", fmt.Errorf("%w: unsupported version", ErrBadHandshake)
+	}
+	key, _ := req.Headers.Get("Sec-WebSocket-Key")
+	key = strings.TrimSpace(key)
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return "", fmt.Errorf("%w: invalid Sec-WebSocket-Key %q", ErrBadHandshake, key)
+	}
+	return key, nil
+}
@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"bytes"
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: keep-alive, Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n\r\n"
+
+func TestAcceptKey(t *testing.T) {
+	// Test: the example from RFC 6455 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		replace [2]string
+		status  string
+	}{
+		{"Not GET", [2]string{"GET", "POST"}, "400"},
+		{"HTTP/1.0", [2]string{"HTTP/1.1", "HTTP/1.0"}, "400"},
+		{"No Upgrade", [2]string{"Upgrade: websocket\r\n", ""}, "400"},
+		{"Upgrade to something else", [2]string{"Upgrade: websocket", "Upgrade: h2c"}, "400"},
+		{"No Connection: Upgrade", [2]string{"keep-alive, Upgrade", "keep-alive"}, "400"},
+		{"Short key", [2]string{"dGhlIHNhbXBsZSBub25jZQ==", "dGhlIHNhbXBsZQ=="}, "400"},
+		{"No key", [2]string{"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n", ""}, "400"},
+		{"Old version", [2]string{"Version: 13", "Version: 8"}, "426"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			raw := strings.Replace(handshake, tc.replace[0], tc.replace[1], 1)
+			req, err := request.RequestFromReader(strings.NewReader(raw))
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			w := response.NewWriter(&buf)
+			_, err = Upgrade(w, req)
+			assert.ErrorIs(t, err, ErrBadHandshake)
+			require.NoError(t, w.Finish())
+			assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 "+tc.status))
+			if tc.status == "426" {
+				assert.Contains(t, buf.String(), "Sec-Websocket-Version: 13\r\n")
+			}
+		})
+	}
+
+	// Test: a valid handshake still needs a connection to take over, the
+	// client is told so and the connection closed
+	req, err := request.RequestFromReader(strings.NewReader(handshake))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	w.SetKeepAlive(true)
+	_, err = Upgrade(w, req)
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+	require.NoError(t, w.Finish())
+	assert.True(t, strings.HasPrefix(buf.String(), "HTTP/1.1 501 Not Implemented\r\n"))
+	assert.Contains(t, buf.String(), "Connection: close\r\n")
+	assert.False(t, w.KeepAlive())
+}